@@ -0,0 +1,117 @@
+// Command bank runs a bank of elevators on simulated hardware in one process, talking over an in-memory
+// network. For integration testing and demos.
+//
+// Commands are read from stdin, "<car> <command>" operates the sim of car number <car> (1 is the first),
+// see driver.Sim.Command. Without a car number, hall calls go to the first car's panel and p prints every car.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/knutaldrin/elevator/controller"
+	"github.com/knutaldrin/elevator/driver"
+	"github.com/knutaldrin/elevator/log"
+	"github.com/knutaldrin/elevator/net"
+)
+
+func main() {
+	cars := flag.Int("cars", 3, "Number of elevators")
+	firstID := flag.Uint("firstid", 1, "ID of the first elevator, the others count up from it")
+	floors := flag.Int("floors", driver.DefaultFloors, "Number of floors in the building")
+	travel := flag.Duration("travel", 2*time.Second, "How long a car takes from one floor to the next")
+	dwell := flag.Duration("dwell", time.Second, "How long the door stays open")
+	doorMove := flag.Duration("doormove", 250*time.Millisecond, "How long the door takes to open or close")
+	stuckAfter := flag.Duration("stuck", 10*time.Second, "Obstructed door time before giving up hall orders")
+	assign := flag.String("assign", "cost", "Hall order assignment: cost (auction) or timer (first come)")
+	bidWindow := flag.Duration("bidwindow", 200*time.Millisecond, "How long cost assignment waits for bids")
+	log.Flags()
+	flag.Parse()
+	if err := log.Start(); err != nil {
+		log.Error("Log file: ", err)
+		os.Exit(1)
+	}
+	log.HandleSignals()
+
+	if *cars < 1 || *firstID+uint(*cars)-1 > 0xffff {
+		log.Error("Need at least one car, and IDs up to 65535")
+		os.Exit(1)
+	}
+	if *floors < 2 || *floors > 200 {
+		log.Error("Number of floors must be between 2 and 200")
+		os.Exit(1)
+	}
+
+	hub := net.NewHub()
+	sims := make([]*driver.Sim, *cars)
+	elevs := make([]*controller.Elevator, *cars)
+	for i := range elevs {
+		sims[i] = driver.NewSim(driver.Floor(*floors))
+		sims[i].TravelTime = *travel
+
+		var err error
+		elevs[i], err = controller.New(controller.Config{
+			ID:         *firstID + uint(i),
+			NumFloors:  driver.Floor(*floors),
+			Dwell:      *dwell,
+			DoorMove:   *doorMove,
+			StuckAfter: *stuckAfter,
+			Assign:     *assign,
+			FloorTime:  *travel,
+			BidWindow:  *bidWindow,
+		}, sims[i], hub.Link())
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	sigtermCh := make(chan os.Signal, 1)
+	signal.Notify(sigtermCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigtermCh
+		for _, e := range elevs {
+			e.Halt()
+			log.Info("Elevator ", e.ID(), " network delivery: ", e.Endpoint().Stats())
+		}
+		log.Check(log.Close())
+		os.Exit(0)
+	}()
+
+	for _, e := range elevs {
+		go e.Run()
+	}
+	log.Info("Running ", *cars, " elevators, commands are read from stdin")
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		car, err := strconv.Atoi(fields[0])
+		if err != nil {
+			if fields[0] == "p" {
+				for i, s := range sims {
+					log.Text(fmt.Sprint("Car ", i+1, ": ", s))
+				}
+			} else {
+				sims[0].Command(scanner.Text())
+			}
+			continue
+		}
+		if car < 1 || car > *cars {
+			log.Warning("Cars are 1 to ", *cars)
+			continue
+		}
+		sims[car-1].Command(strings.Join(fields[1:], " "))
+	}
+	select {}
+}
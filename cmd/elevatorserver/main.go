@@ -0,0 +1,68 @@
+// Command elevatorserver emulates the lab's elevator server with simulated cars,
+// so the elevator can be run with -driver tcp without any hardware.
+//
+// Car n listens on port+n. The cars are operated from stdin, see driver.Sim.Command.
+// With more than one car, every command is prefixed by the car number, e.g. "1 c 3".
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/knutaldrin/elevator/driver"
+	"github.com/knutaldrin/elevator/log"
+)
+
+func main() {
+	port := flag.Int("port", 15657, "TCP port of the first car")
+	cars := flag.Int("cars", 1, "Number of cars")
+	travel := flag.Duration("travel", 2*time.Second, "Travel time between floors")
+	floors := flag.Int("floors", driver.DefaultFloors, "Number of floors")
+	log.Flags()
+	flag.Parse()
+	if err := log.Start(); err != nil {
+		log.Error("Log file: ", err)
+		os.Exit(1)
+	}
+	log.HandleSignals()
+
+	sims := make([]*driver.Sim, *cars)
+	for i := range sims {
+		sims[i] = driver.NewSim(driver.Floor(*floors))
+		sims[i].TravelTime = *travel
+
+		l, err := net.Listen("tcp", fmt.Sprint(":", *port+i))
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		log.Info("Car ", i, " listening on ", l.Addr())
+		go func(l net.Listener, sim *driver.Sim) {
+			log.Error(driver.ServeTCP(l, sim, driver.Floor(*floors)))
+			os.Exit(1)
+		}(l, sims[i])
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := scanner.Text()
+		car := 0
+		if len(sims) > 1 {
+			fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+			if _, err := fmt.Sscan(fields[0], &car); err != nil || car < 0 || car >= len(sims) || len(fields) < 2 {
+				log.Warning("Prefix commands with a car number between 0 and ", len(sims)-1)
+				continue
+			}
+			line = fields[1]
+		}
+		sims[car].Command(line)
+	}
+
+	// Keep serving when stdin is closed, e.g. when started in the background
+	select {}
+}
@@ -0,0 +1,107 @@
+// Command keypad is a destination dispatch keypad for the lobby. It joins the elevators on the network,
+// reads "<from> <to>" floor pairs from stdin, and tells which car to take.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/knutaldrin/elevator/driver"
+	"github.com/knutaldrin/elevator/log"
+	"github.com/knutaldrin/elevator/net"
+	"github.com/knutaldrin/elevator/net/udp"
+)
+
+type call struct {
+	from, to driver.Floor
+}
+
+func main() {
+	id := flag.Uint("id", 60000, "Keypad ID, not shared with any elevator")
+	floors := flag.Int("floors", driver.DefaultFloors, "Number of floors in the building")
+	iface := flag.String("iface", "", "Network interface to use")
+	bcast := flag.String("bcast", "", "Broadcast address")
+	mcast := flag.String("mcast", "", "Multicast group to use instead of broadcast")
+	lport := flag.Int("lport", net.LPORT, "Local UDP port")
+	bport := flag.Int("bport", net.BPORT, "Broadcast UDP port")
+	group := flag.Uint("group", 0, "Elevator group")
+	keyFile := flag.String("keyfile", "", "Network key file, if the elevators use one")
+	log.Flags()
+	flag.Parse()
+	if err := log.Start(); err != nil {
+		log.Error("Log file: ", err)
+		os.Exit(1)
+	}
+
+	if *id > 0xffff || *group > 0xffff {
+		log.Error("ID and group must be between 0 and 65535")
+		os.Exit(1)
+	}
+	if *keyFile != "" {
+		if err := net.LoadKeys(*keyFile); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	receiveCh := make(chan net.OrderMessage, 8)
+	peerCh := make(chan net.PeerUpdate, 8)
+	onlineCh := make(chan bool, 8)
+	endpoint := net.NewEndpoint(net.Config{
+		ID:        *id,
+		NumFloors: driver.Floor(*floors),
+		Group:     uint16(*group),
+		Keypad:    true,
+	}, net.UDPLink(udp.Config{
+		Interface:     *iface,
+		Broadcast:     *bcast,
+		Multicast:     *mcast,
+		TTL:           1,
+		Loopback:      true,
+		LocalPort:     *lport,
+		BroadcastPort: *bport,
+	}))
+	go endpoint.Handle(receiveCh, peerCh, onlineCh)
+
+	inputCh := make(chan call)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			var c call
+			if _, err := fmt.Sscan(scanner.Text(), &c.from, &c.to); err != nil {
+				log.Warning("Enter <from> <to>")
+				continue
+			}
+			if c.from < 0 || c.to < 0 || int(c.from) >= *floors || int(c.to) >= *floors || c.from == c.to {
+				log.Warning("Floors are 0 to ", *floors-1, ", and you have to go somewhere")
+				continue
+			}
+			inputCh <- c
+		}
+	}()
+
+	waiting := make(map[net.CallID]call)
+	for {
+		select {
+		case c := <-inputCh:
+			waiting[endpoint.SendCall(c.from, c.to)] = c
+
+		case o := <-receiveCh:
+			if o.Type != net.AcceptedOrder || o.Call == nil {
+				break
+			}
+			if c, ok := waiting[*o.Call]; ok {
+				log.Info("From floor ", c.from, " to ", c.to, ": take car ", o.SenderID)
+				delete(waiting, *o.Call)
+			}
+
+		case <-peerCh:
+		case online := <-onlineCh:
+			if !online {
+				log.Warning("Offline, nobody will hear us")
+			}
+		}
+	}
+}
@@ -0,0 +1,418 @@
+// Package controller runs one elevator: its car, its queue and its place on the network.
+// Several can run in one process, e.g. on simulated hardware sharing a net.Hub.
+package controller
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/knutaldrin/elevator/door"
+	"github.com/knutaldrin/elevator/driver"
+	"github.com/knutaldrin/elevator/log"
+	"github.com/knutaldrin/elevator/net"
+	"github.com/knutaldrin/elevator/queue"
+	"github.com/knutaldrin/elevator/store"
+)
+
+// Config of one elevator
+type Config struct {
+	ID        uint
+	NumFloors driver.Floor
+	Group     uint16
+
+	Dwell      time.Duration // How long the door stays open
+	DoorMove   time.Duration // How long the door takes to open or close
+	StuckAfter time.Duration // Obstructed door time before giving up hall orders
+
+	// Assign is the hall order assignment, "cost" (auction) or "timer" (first come). Same for every elevator in a group.
+	Assign    string
+	FloorTime time.Duration // How long the car takes from one floor to the next, for estimating costs
+	BidWindow time.Duration // How long cost assignment waits for bids
+
+	// OrderLog keeps our orders over restarts. Nil to forget them.
+	OrderLog queue.OrderLog
+	// Store keeps where we were over restarts. Nil to forget it.
+	Store *store.Store
+}
+
+// Elevator bundles a car, its queue and its network endpoint
+type Elevator struct {
+	cfg Config
+
+	drv      *driver.Driver
+	queue    *queue.Queue
+	endpoint *net.Endpoint
+	door     *door.Door
+	log      *log.Logger
+
+	timeoutCh chan bool
+}
+
+// New sets up an elevator on the hardware and link. Nothing moves before Run.
+func New(cfg Config, hw driver.Elevator, link net.Link) (*Elevator, error) {
+	if cfg.ID > 0xffff {
+		return nil, fmt.Errorf("elevator ID must be between 0 and 65535")
+	}
+	if cfg.NumFloors < 2 || cfg.NumFloors > 200 {
+		return nil, fmt.Errorf("number of floors must be between 2 and 200")
+	}
+
+	logger := log.With("elevator", cfg.ID)
+	drv, err := driver.New(hw, cfg.NumFloors, logger)
+	if err != nil {
+		return nil, err
+	}
+	e := &Elevator{
+		cfg:       cfg,
+		drv:       drv,
+		endpoint:  net.NewEndpoint(net.Config{ID: cfg.ID, NumFloors: cfg.NumFloors, Group: cfg.Group}, link),
+		door:      door.New(drv, cfg.Dwell, cfg.DoorMove, cfg.StuckAfter, logger),
+		log:       logger,
+		timeoutCh: make(chan bool, 8),
+	}
+
+	var assigner queue.Assigner
+	switch cfg.Assign {
+	case "cost", "":
+		assigner = queue.NewCostAssigner(cfg.ID, cfg.BidWindow, e.endpoint.Peers)
+	case "timer":
+		assigner = queue.TimerAssigner{ID: cfg.ID, FloorTime: cfg.FloorTime}
+	default:
+		return nil, fmt.Errorf("unknown assignment strategy %s", cfg.Assign)
+	}
+
+	e.queue = queue.New(queue.Config{
+		ID:        cfg.ID,
+		NumFloors: cfg.NumFloors,
+		FloorTime: cfg.FloorTime,
+		DoorTime:  cfg.Dwell + 2*cfg.DoorMove,
+		Assigner:  assigner,
+		Lamp: func(floor driver.Floor, dir driver.Direction, on bool) {
+			if on {
+				drv.ButtonLightOn(floor, dir)
+			} else {
+				drv.ButtonLightOff(floor, dir)
+			}
+		},
+		Send:     e.endpoint.SendOrder,
+		Timeout:  e.timeoutCh,
+		OrderLog: cfg.OrderLog,
+	})
+	return e, nil
+}
+
+// ID of the elevator
+func (e *Elevator) ID() uint {
+	return e.cfg.ID
+}
+
+// Endpoint is our place on the network
+func (e *Elevator) Endpoint() *net.Endpoint {
+	return e.endpoint
+}
+
+// wake the event loop to look for something to do. Never blocks, the loop is the only one draining
+// timeoutCh, and a full channel means it will look anyway.
+func (e *Elevator) wake() {
+	select {
+	case e.timeoutCh <- true:
+	default:
+	}
+}
+
+// Halt stops the motor, e.g. on the way out
+func (e *Elevator) Halt() {
+	e.drv.Stop()
+}
+
+/** POSITION FILE, in the store
+ * 2 bytes: last floor
+ * 1 byte: last direction of travel
+ */
+
+const positionSchema = 1
+
+// loadPosition gives where we were when we last ran, if we know
+func (e *Elevator) loadPosition() (driver.Floor, driver.Direction, bool) {
+	if e.cfg.Store == nil {
+		return 0, driver.DirectionNone, false
+	}
+	buf, err := e.cfg.Store.Read("position", positionSchema)
+	if err != nil {
+		e.log.Error(err)
+		return 0, driver.DirectionNone, false
+	}
+	if len(buf) != 3 {
+		return 0, driver.DirectionNone, false
+	}
+	floor, dir := driver.Floor(binary.BigEndian.Uint16(buf)), driver.Direction(buf[2])
+	if floor < 0 || floor >= e.cfg.NumFloors || dir > driver.DirectionNone {
+		e.log.Warning("Last position, floor ", floor, ", dir ", dir, ", is outside the building")
+		return 0, driver.DirectionNone, false
+	}
+	return floor, dir, true
+}
+
+func (e *Elevator) savePosition(floor driver.Floor, dir driver.Direction) {
+	if e.cfg.Store == nil {
+		return
+	}
+	buf := append(binary.BigEndian.AppendUint16(nil, uint16(floor)), byte(dir))
+	if err := e.cfg.Store.Write("position", positionSchema, buf); err != nil {
+		e.log.Error("Saving position: ", err)
+	}
+}
+
+// Run serves orders, forever
+func (e *Elevator) Run() {
+	q, drv, cabDoor := e.queue, e.drv, e.door
+
+	currentDirection := driver.DirectionDown
+	lastFloor := driver.Floor(0)
+
+	stopped := false
+	inService := true
+
+	orderReceiveCh := make(chan net.OrderMessage, 8)
+	peerCh := make(chan net.PeerUpdate, 8)
+	onlineCh := make(chan bool, 8)
+	go e.endpoint.Handle(orderReceiveCh, peerCh, onlineCh)
+
+	savedFloor, savedDirection, known := e.loadPosition()
+	if known {
+		e.log.Info("Was at floor ", savedFloor, ", dir: ", savedDirection, " before restarting")
+		currentDirection = savedDirection
+		lastFloor = savedFloor
+	}
+
+	// Nothing moves with the stop button in, someone may be climbing out. Out of service until it's
+	// released, which the stop button case below handles like any other.
+	stopped = drv.StopPressed()
+	if stopped {
+		e.log.Warning("Stop button is in, out of service until it is released")
+		drv.StopLightOn()
+		cabDoor.Hold(true)
+	}
+
+	// Make sure elevator is at a floor, then carry on where we left off. At a floor finding it doesn't move.
+	if !stopped || drv.AtFloor() {
+		lastFloor = drv.Reset(currentDirection)
+	}
+	if stopped && drv.AtFloor() {
+		cabDoor.Open()
+	}
+	q.Update(lastFloor)
+	if known {
+		q.SetDirection(currentDirection)
+	}
+
+	floorCh := make(chan driver.Floor)
+	go drv.FloorListener(floorCh)
+
+	floorBtnCh := make(chan driver.ButtonEvent, 8)
+	go drv.FloorButtonListener(floorBtnCh)
+
+	stopBtnCh := make(chan bool)
+	go drv.StopButtonListener(stopBtnCh)
+
+	obstructionCh := make(chan bool)
+	go drv.ObstructionListener(obstructionCh)
+
+	// Out of service while the stop button is in or the door is stuck
+	updateService := func() {
+		if inService == (!stopped && !cabDoor.IsStuck()) {
+			return
+		}
+		inService = !inService
+		q.SetInService(inService)
+		if inService {
+			e.log.Info("Back in service")
+			e.endpoint.SendOrder(net.OrderMessage{Type: net.InService})
+		} else {
+			e.log.Warning("Out of service")
+			e.endpoint.SendOrder(net.OrderMessage{Type: net.OutOfService})
+		}
+	}
+
+	// Hand back the recovered orders at once if we can't serve them, so nobody waits for our timers
+	updateService()
+	q.Recover(inService)
+
+	// Ping timeout so we start in case we have logged orders from a previous crash
+	e.wake()
+
+	// Main event loop
+	for {
+		select {
+		// Elevator has arrived at a new floor
+		case fl := <-floorCh:
+			lastFloor = fl
+			q.Update(fl)
+			if q.ShouldStop(fl) {
+				drv.Stop()
+				q.ClearOrderLocal(fl, currentDirection)
+				e.log.With("floor", fl, "dir", currentDirection).Debug("Stopped")
+				e.endpoint.SendOrder(net.OrderMessage{Type: net.CompletedOrder, Floor: fl, Direction: currentDirection})
+
+				cabDoor.Open()
+			}
+
+		// A floor button was pressed
+		case btn := <-floorBtnCh:
+			if btn.Dir == driver.DirectionNone && btn.Floor == drv.CurrentFloor() && !drv.Moving() {
+				// Already here, let them in. With the stop button in the door is held open already.
+				cabDoor.Open()
+				break
+			}
+			q.NewOrder(btn.Floor, btn.Dir)
+			if btn.Dir != driver.DirectionNone {
+				e.endpoint.SendOrder(net.OrderMessage{Type: net.NewOrder, Floor: btn.Floor, Direction: btn.Dir})
+			}
+			if cabDoor.IsClosed() && !stopped {
+				currentDirection = q.NextDirection()
+				drv.Run(currentDirection)
+			}
+
+		// Emergency stop, out of service until released
+		case pressed := <-stopBtnCh:
+			if pressed == stopped {
+				break
+			}
+			stopped = pressed
+			if stopped {
+				drv.Stop()
+				drv.StopLightOn()
+				if drv.AtFloor() {
+					cabDoor.Open()
+				}
+				cabDoor.Hold(true)
+				e.log.Warning("Stop button pressed")
+			} else {
+				drv.StopLightOff()
+				cabDoor.Hold(false)
+				e.log.Info("Stop button released")
+
+				// Otherwise we go when the door closes
+				if cabDoor.IsClosed() {
+					next := q.NextDirection()
+					if next == driver.DirectionNone && !drv.AtFloor() {
+						// Stopped between floors with nothing to do, get to the next floor at least
+						next = currentDirection
+					}
+					currentDirection = next
+					drv.Run(currentDirection)
+				}
+			}
+			updateService()
+
+		// Something is in the door, or not anymore
+		case obstructed := <-obstructionCh:
+			cabDoor.Obstruction(obstructed)
+			updateService()
+
+		// Door timer ran out
+		case <-cabDoor.C:
+			switch cabDoor.Tick() {
+			case door.EventClosed:
+				e.wake()
+			case door.EventStuck:
+				updateService()
+			}
+
+		// A message came in from the network
+		case o := <-orderReceiveCh:
+			msgLog := e.log.With("type", o.Type, "from", o.SenderID)
+			switch o.Type {
+			case net.NewOrder:
+				msgLog.With("floor", o.Floor, "dir", o.Direction).Debug("New order")
+				q.NewOrder(o.Floor, o.Direction)
+
+			case net.AcceptedOrder:
+				msgLog.With("floor", o.Floor, "dir", o.Direction).Debug("Remote accepted order")
+				q.OrderAcceptedRemotely(o.Floor, o.Direction, o.SenderID, o.Call)
+
+			case net.CompletedOrder:
+				msgLog.With("floor", o.Floor, "dir", o.Direction).Debug("Remote completed order")
+				q.ClearOrder(o.Floor, o.Direction, o.Call)
+
+			case net.ReleasedOrder:
+				msgLog.With("floor", o.Floor, "dir", o.Direction).Debug("Remote released order")
+				q.OrderReleased(o.Floor, o.Direction, o.Call)
+
+			case net.OutOfService:
+				msgLog.Warning("Elevator ", o.SenderID, " is out of service")
+
+			case net.InService:
+				msgLog.Info("Elevator ", o.SenderID, " is back in service")
+
+			case net.Bid:
+				q.Bid(o.Floor, o.Direction, o.Call, o.SenderID, o.Cost)
+
+			case net.DestinationCall:
+				msgLog.With("floor", o.Floor, "dest", o.Destination).Debug("Destination call")
+				q.NewCall(o.Floor, *o.Call, o.Destination)
+
+			case net.Snapshot:
+				msgLog.Debug("Snapshot from elevator ", o.SenderID, " with ", len(o.Orders), " hall orders")
+				q.Merge(o.Orders)
+			}
+
+		// An elevator joined or was lost
+		case p := <-peerCh:
+			if p.Lost {
+				q.PeerLost(p.ID)
+			} else {
+				// New here, or has a different view of the world. Tell it what we know.
+				e.endpoint.SendSnapshot(q.Snapshot())
+			}
+
+		// Lost or got back the network
+		case online := <-onlineCh:
+			if !online {
+				e.log.Warning("Offline, serving every hall order alone")
+			}
+			q.SetOffline(!online)
+
+		// Something timed out. Wake if idle.
+		case <-e.timeoutCh:
+			if stopped {
+				// Keep which way we were going, for getting to a floor when released
+				break
+			}
+			currentDirection = q.NextDirection()
+			if !cabDoor.IsClosed() {
+				break
+			}
+			if currentDirection == driver.DirectionNone && drv.AtFloor() {
+				if dir, ok := q.ServeHere(); ok {
+					// Someone is waiting right where we are
+					currentDirection = dir
+					if dir != driver.DirectionNone {
+						e.endpoint.SendOrder(net.OrderMessage{Type: net.CompletedOrder, Floor: lastFloor, Direction: dir})
+					}
+					cabDoor.Open()
+					break
+				}
+			}
+			drv.Run(currentDirection)
+		}
+
+		if lastFloor != savedFloor || (currentDirection != driver.DirectionNone && currentDirection != savedDirection) {
+			savedFloor = lastFloor
+			if currentDirection != driver.DirectionNone {
+				savedDirection = currentDirection
+			}
+			e.savePosition(savedFloor, savedDirection)
+		}
+
+		q.SetDoorOpen(!cabDoor.IsClosed())
+		e.endpoint.SetStatus(net.Status{
+			Floor:     lastFloor,
+			Direction: currentDirection,
+			DoorOpen:  !cabDoor.IsClosed(),
+			InService: inService,
+			Orders:    net.Digest(q.Snapshot()),
+		})
+	}
+}
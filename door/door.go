@@ -0,0 +1,201 @@
+package door
+
+import (
+	"time"
+
+	"github.com/knutaldrin/elevator/driver"
+	"github.com/knutaldrin/elevator/log"
+)
+
+// State of the door
+type State int
+
+// enum definitions for door state
+const (
+	Closed State = iota
+	Opening
+	Open
+	Closing
+)
+
+func (s State) String() string {
+	return [...]string{"closed", "opening", "open", "closing"}[s]
+}
+
+// Event is what happened when the door timer ran out
+type Event int
+
+// enum definitions for door events
+const (
+	NoEvent     Event = iota
+	EventClosed       // The door is fully closed, the elevator may move
+	EventStuck        // The door has been obstructed for too long
+)
+
+// Door keeps the door open for a while and closes it when nothing is in the way.
+// The door open lamp is lit in every state but Closed.
+// Not thread safe, it belongs to the event loop. Call Tick when C fires.
+type Door struct {
+	// Dwell is how long the door stays open
+	Dwell time.Duration
+	// MoveTime is how long the door takes to open or close
+	MoveTime time.Duration
+	// StuckAfter is how long the door may be obstructed before we give up on it
+	StuckAfter time.Duration
+
+	// C fires when Tick should be called
+	C <-chan time.Time
+
+	drv   *driver.Driver
+	timer *time.Timer
+	log   *log.Logger
+
+	state           State
+	held, stuck     bool
+	obstructed      bool
+	obstructedSince time.Time
+	deadline        time.Time // when the current state is over
+}
+
+// New makes a closed door for the car. Logs go to logger, nil for the plain log.
+func New(drv *driver.Driver, dwell, moveTime, stuckAfter time.Duration, logger *log.Logger) *Door {
+	if logger == nil {
+		logger = log.With()
+	}
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	return &Door{Dwell: dwell, MoveTime: moveTime, StuckAfter: stuckAfter, drv: drv, timer: timer, C: timer.C, log: logger}
+}
+
+// State of the door
+func (d *Door) State() State {
+	return d.state
+}
+
+// IsClosed is true if the car may move
+func (d *Door) IsClosed() bool {
+	return d.state == Closed
+}
+
+// IsStuck is true while the door has been obstructed for longer than StuckAfter
+func (d *Door) IsStuck() bool {
+	return d.stuck
+}
+
+func (d *Door) enter(s State, duration time.Duration) {
+	d.log.Bullshit("Door ", d.state, " -> ", s)
+	d.state = s
+	d.deadline = time.Now().Add(duration)
+	d.arm()
+}
+
+// arm makes C fire at the next point something can happen. Stale fires are harmless, Tick checks the clock.
+// An open door does nothing while held or stuck until Hold or Obstruction is called.
+func (d *Door) arm() {
+	if d.state == Closed {
+		return
+	}
+	if d.state == Open && d.obstructed {
+		if !d.stuck {
+			d.timer.Reset(time.Until(d.obstructedSince.Add(d.StuckAfter)))
+		}
+		return
+	}
+	if d.state == Open && d.held {
+		return
+	}
+	d.timer.Reset(time.Until(d.deadline))
+}
+
+// Open opens the door, reopens it if closing, or keeps it open for another Dwell
+func (d *Door) Open() {
+	switch d.state {
+	case Closed:
+		d.drv.OpenDoor()
+		d.enter(Opening, d.MoveTime)
+	case Closing:
+		// Back out the way it came
+		d.enter(Opening, d.MoveTime-time.Until(d.deadline))
+	case Open:
+		d.enter(Open, d.Dwell)
+	}
+}
+
+// Hold keeps the door open until released, e.g. while the stop button is in
+func (d *Door) Hold(on bool) {
+	d.held = on
+	if !on && d.state == Open {
+		d.enter(Open, d.Dwell)
+	}
+}
+
+// Obstruction is called when the obstruction sensor changes. The door won't close while obstructed,
+// and the dwell time starts over when it clears.
+func (d *Door) Obstruction(on bool) {
+	if on == d.obstructed {
+		return
+	}
+	d.obstructed = on
+	if on {
+		d.obstructedSince = time.Now()
+		switch d.state {
+		case Closing:
+			d.Open()
+		case Open:
+			d.arm()
+		}
+		return
+	}
+
+	if d.stuck {
+		d.log.Info("Door no longer obstructed")
+	}
+	d.stuck = false
+	if d.state == Open {
+		d.enter(Open, d.Dwell)
+	}
+}
+
+// Tick is called when C fires
+func (d *Door) Tick() Event {
+	now := time.Now()
+
+	switch d.state {
+	case Opening:
+		if now.Before(d.deadline) {
+			d.arm()
+			return NoEvent
+		}
+		if d.obstructed {
+			// Count from when the door is actually open
+			d.obstructedSince = now
+		}
+		d.enter(Open, d.Dwell)
+
+	case Open:
+		if d.obstructed {
+			if !d.stuck && !now.Before(d.obstructedSince.Add(d.StuckAfter)) {
+				d.stuck = true
+				d.log.Warning("Door obstructed for more than ", d.StuckAfter)
+				return EventStuck
+			}
+			d.arm()
+			return NoEvent
+		}
+		if d.held || now.Before(d.deadline) {
+			d.arm()
+			return NoEvent
+		}
+		d.enter(Closing, d.MoveTime)
+
+	case Closing:
+		if now.Before(d.deadline) {
+			d.arm()
+			return NoEvent
+		}
+		d.enter(Closed, 0)
+		d.drv.CloseDoor()
+		return EventClosed
+	}
+	return NoEvent
+}
@@ -0,0 +1,74 @@
+//go:build comedi
+
+package driver
+
+/*
+#cgo CFLAGS: -std=c11
+#cgo LDFLAGS: -lcomedi -lm
+#include "elev.h"
+#include "io.h"
+*/
+import "C"
+import "fmt"
+
+// comedi talks to the lab hardware through libcomedi. Build with -tags comedi.
+type comedi struct{}
+
+func init() {
+	defaultBackend = "comedi"
+	register("comedi", func(addr string, floors Floor) (Elevator, error) {
+		if floors != C.N_FLOORS {
+			return nil, fmt.Errorf("driver: the lab elevator has %d floors, not %d", C.N_FLOORS, floors)
+		}
+		return comedi{}, nil
+	})
+}
+
+func cBool(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (comedi) Init() error {
+	// elev_init asserts on failure, so there is nothing to return
+	C.elev_init()
+	return nil
+}
+
+func (comedi) SetMotorDirection(dir MotorDirection) {
+	C.elev_set_motor_direction(C.elev_motor_direction_t(dir))
+}
+
+func (comedi) SetButtonLamp(button Direction, floor Floor, on bool) {
+	C.elev_set_button_lamp(C.elev_button_type_t(button), C.int(floor), cBool(on))
+}
+
+func (comedi) SetFloorIndicator(floor Floor) {
+	C.elev_set_floor_indicator(C.int(floor))
+}
+
+func (comedi) SetDoorOpenLamp(on bool) {
+	C.elev_set_door_open_lamp(cBool(on))
+}
+
+func (comedi) SetStopLamp(on bool) {
+	C.elev_set_stop_lamp(cBool(on))
+}
+
+func (comedi) ButtonSignal(button Direction, floor Floor) bool {
+	return C.elev_get_button_signal(C.elev_button_type_t(button), C.int(floor)) != 0
+}
+
+func (comedi) FloorSensorSignal() Floor {
+	return Floor(C.elev_get_floor_sensor_signal())
+}
+
+func (comedi) StopSignal() bool {
+	return C.elev_get_stop_signal() != 0
+}
+
+func (comedi) ObstructionSignal() bool {
+	return C.elev_get_obstruction_signal() != 0
+}
@@ -1,21 +1,15 @@
 package driver
 
-/*
-#cgo CFLAGS: -std=c11
-#cgo LDFLAGS: -lcomedi -lm
-#include "elev.h"
-#include "io.h"
-*/
-import "C"
 import (
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/knutaldrin/elevator/log"
 )
 
-// NumFloors = number of floors in elevator
-const NumFloors = 4
+// DefaultFloors is the number of floors in the lab
+const DefaultFloors = 4
 
 // Direction of travel
 type Direction int8
@@ -27,6 +21,15 @@ const (
 	DirectionNone Direction = 2
 )
 
+var directionNames = [...]string{"up", "down", "none"}
+
+func (d Direction) String() string {
+	if d < DirectionUp || d > DirectionNone {
+		return "direction(" + strconv.Itoa(int(d)) + ")"
+	}
+	return directionNames[d]
+}
+
 // Floor is a floor. negative -> invalid (bitsize arbitrary)
 type Floor int16
 
@@ -36,188 +39,286 @@ type ButtonEvent struct {
 	Floor Floor
 }
 
-var mutex = &sync.Mutex{}
+// Polling rate for listeners. Far shorter than any button press.
+const pollInterval = time.Millisecond
 
-func setFloorIndicator(floor Floor) {
-	mutex.Lock()
-	C.elev_set_floor_indicator(C.int(floor))
-	mutex.Unlock()
+// Driver is one car on one backend. It keeps the motor and door interlocked, and only one call at a time
+// reaches the backend.
+type Driver struct {
+	mutex     sync.Mutex
+	elev      Elevator
+	numFloors Floor
+
+	// Interlock state, guarded by mutex. The motor never runs while the door is open.
+	doorOpen bool
+	motor    MotorDirection
+
+	log *log.Logger
 }
 
-func getFloor() Floor {
-	mutex.Lock()
-	floor := Floor(C.elev_get_floor_sensor_signal())
-	mutex.Unlock()
-	return floor
+// New initializes the elevator on the given backend, resets all lamps. Logs go to logger, nil for the plain log.
+func New(e Elevator, floors Floor, logger *log.Logger) (*Driver, error) {
+	if logger == nil {
+		logger = log.With()
+	}
+	logger.Debug("Initializing driver")
+	d := &Driver{elev: e, numFloors: floors, log: logger}
+	if err := e.Init(); err != nil {
+		return nil, err
+	}
+	return d, nil
 }
 
-// Init initializes the elevator, resets all lamps.
-func Init() {
-	log.Debug("Initializing driver")
-	C.elev_init()
+// NumFloors = number of floors in elevator
+func (d *Driver) NumFloors() Floor {
+	return d.numFloors
+}
+
+func (d *Driver) setFloorIndicator(floor Floor) {
+	d.mutex.Lock()
+	d.elev.SetFloorIndicator(floor)
+	d.mutex.Unlock()
+}
+
+func (d *Driver) getFloor() Floor {
+	d.mutex.Lock()
+	floor := d.elev.FloorSensorSignal()
+	d.mutex.Unlock()
+	return floor
 }
 
-// Reset makes sure the elevator is at a safe floor on startup
+// Reset makes sure the elevator is at a safe floor on startup, looking for one the way we were going.
+// Down unless we know better.
 // Blocking, should never be called when listeners are running
-func Reset() Floor {
-	log.Debug("Resetting floor")
-	currentFloor := getFloor()
+func (d *Driver) Reset(dir Direction) Floor {
+	d.log.Debug("Resetting floor")
+	currentFloor := d.getFloor()
 
 	if currentFloor == -1 {
-		log.Warning("Unknown floor")
-		// Move down until we hit something
-		RunDown()
+		d.log.Warning("Unknown floor")
+		// Move until we hit something
+		if dir == DirectionUp {
+			d.RunUp()
+		} else {
+			d.RunDown()
+		}
 		for {
-			currentFloor = getFloor()
+			time.Sleep(pollInterval)
+			currentFloor = d.getFloor()
 			if currentFloor != -1 {
 				break
 			}
 		}
-		log.Info("At floor ", currentFloor, ", ready for service")
-		setFloorIndicator(currentFloor)
-		Stop()
-		OpenDoor()
+		d.log.Info("At floor ", currentFloor, ", ready for service")
+		d.setFloorIndicator(currentFloor)
+		d.Stop()
+		d.OpenDoor()
 		time.Sleep(time.Second)
-		CloseDoor()
+		d.CloseDoor()
 	}
 	return currentFloor
 }
 
 // OpenDoor opens the door
-func OpenDoor() {
-	mutex.Lock()
-	C.elev_set_door_open_lamp(1)
-	mutex.Unlock()
+func (d *Driver) OpenDoor() {
+	d.mutex.Lock()
+	if d.motor != MotorStop {
+		d.log.Error("Opening the door while moving?! Stopping")
+		d.motor = MotorStop
+		d.elev.SetMotorDirection(MotorStop)
+	}
+	d.doorOpen = true
+	d.elev.SetDoorOpenLamp(true)
+	d.mutex.Unlock()
 }
 
 // CloseDoor closes the door
-func CloseDoor() {
-	mutex.Lock()
-	C.elev_set_door_open_lamp(0)
-	mutex.Unlock()
+func (d *Driver) CloseDoor() {
+	d.mutex.Lock()
+	d.doorOpen = false
+	d.elev.SetDoorOpenLamp(false)
+	d.mutex.Unlock()
+}
+
+// StopLightOn turns on the stop lamp
+func (d *Driver) StopLightOn() {
+	d.mutex.Lock()
+	d.elev.SetStopLamp(true)
+	d.mutex.Unlock()
+}
+
+// StopLightOff turns off the stop lamp
+func (d *Driver) StopLightOff() {
+	d.mutex.Lock()
+	d.elev.SetStopLamp(false)
+	d.mutex.Unlock()
+}
+
+// AtFloor is true if the floor sensor sees a floor
+func (d *Driver) AtFloor() bool {
+	return d.getFloor() != -1
+}
+
+// CurrentFloor according to the floor sensor, -1 if between floors
+func (d *Driver) CurrentFloor() Floor {
+	return d.getFloor()
+}
+
+// StopPressed is true while the stop button is in
+func (d *Driver) StopPressed() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.elev.StopSignal()
+}
+
+// Moving is true while the motor runs
+func (d *Driver) Moving() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.motor != MotorStop
+}
+
+// setMotor refuses to run with the door open
+func (d *Driver) setMotor(dir MotorDirection) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if dir != MotorStop && d.doorOpen {
+		d.log.Error("Refusing to move with the door open!")
+		return
+	}
+	d.motor = dir
+	d.elev.SetMotorDirection(dir)
 }
 
 // ButtonLightOn turns on the corresponding lamp
-func ButtonLightOn(floor Floor, dir Direction) {
+func (d *Driver) ButtonLightOn(floor Floor, dir Direction) {
 	if floor == 0 && dir == DirectionDown {
 		dir = DirectionUp
-	} else if floor == NumFloors-1 && dir == DirectionUp {
+	} else if floor == d.numFloors-1 && dir == DirectionUp {
 		dir = DirectionDown
 	}
-	mutex.Lock()
-	C.elev_set_button_lamp(C.elev_button_type_t(dir), C.int(floor), 1)
-	mutex.Unlock()
+	d.mutex.Lock()
+	d.elev.SetButtonLamp(dir, floor, true)
+	d.mutex.Unlock()
 }
 
 // ButtonLightOff turns it off
-func ButtonLightOff(floor Floor, dir Direction) {
+func (d *Driver) ButtonLightOff(floor Floor, dir Direction) {
 	if floor == 0 && dir == DirectionDown {
 		dir = DirectionUp
-	} else if floor == NumFloors-1 && dir == DirectionUp {
+	} else if floor == d.numFloors-1 && dir == DirectionUp {
 		dir = DirectionDown
 	}
-	mutex.Lock()
-	C.elev_set_button_lamp(C.elev_button_type_t(dir), C.int(floor), 0)
-	mutex.Unlock()
+	d.mutex.Lock()
+	d.elev.SetButtonLamp(dir, floor, false)
+	d.mutex.Unlock()
 }
 
 // Run aka Walk This Way
-func Run(dir Direction) {
+func (d *Driver) Run(dir Direction) {
 	switch dir {
 	case DirectionUp:
-		RunUp()
+		d.RunUp()
 	case DirectionDown:
-		RunDown()
+		d.RunDown()
 	case DirectionNone:
-		Stop()
+		d.Stop()
 	}
 }
 
 // RunUp runs up
-func RunUp() {
-	if getFloor() == NumFloors-1 {
-		log.Error("Trying to go up from the top floor?!")
+func (d *Driver) RunUp() {
+	if d.getFloor() == d.numFloors-1 {
+		d.log.Error("Trying to go up from the top floor?!")
 		return
 	}
-	mutex.Lock()
-	C.elev_set_motor_direction(1)
-	mutex.Unlock()
+	d.setMotor(MotorUp)
 }
 
 // RunDown runs down
-func RunDown() {
-	if getFloor() == 0 {
-		log.Error("Trying to go down from the bottom floor?!")
+func (d *Driver) RunDown() {
+	if d.getFloor() == 0 {
+		d.log.Error("Trying to go down from the bottom floor?!")
 		return
 	}
-	mutex.Lock()
-	C.elev_set_motor_direction(-1)
-	mutex.Unlock()
+	d.setMotor(MotorDown)
 }
 
 // Stop stops the elevator
-func Stop() {
-	mutex.Lock()
-	C.elev_set_motor_direction(0)
-	mutex.Unlock()
+func (d *Driver) Stop() {
+	d.setMotor(MotorStop)
 }
 
 // FloorListener sends event on floor update
-func FloorListener(ch chan<- Floor) {
-	currentFloor := getFloor()
+func (d *Driver) FloorListener(ch chan<- Floor) {
+	currentFloor := d.getFloor()
 	for {
-		newFloor := getFloor()
+		time.Sleep(pollInterval)
+		newFloor := d.getFloor()
 		if newFloor > -1 {
 			if newFloor != currentFloor {
 				currentFloor = newFloor
-				setFloorIndicator(newFloor)
-				log.Info("Now at floor ", newFloor)
+				d.setFloorIndicator(newFloor)
+				d.log.With("floor", newFloor).Info("Now at floor ", newFloor)
 				ch <- newFloor
 			}
 		}
 	}
 }
 
-// StopButtonListener should be spawned as a goroutine, and will trigger on press
-func StopButtonListener(ch chan<- bool) {
-	var stopButtonState bool
+// switchListener sends the state read starts in, then the new state every time it changes
+func (d *Driver) switchListener(read func() bool, name string, ch chan<- bool) {
+	d.mutex.Lock()
+	state := read()
+	d.mutex.Unlock()
+	ch <- state
 
 	for {
-		mutex.Lock()
-		newState := C.elev_get_stop_signal() != 0
-		mutex.Unlock()
-		if newState != stopButtonState {
-			stopButtonState = newState
-
-			if newState {
-				log.Debug("Stop button pressed")
-			} else {
-				log.Debug("Stop button released")
-			}
+		time.Sleep(pollInterval)
+		d.mutex.Lock()
+		newState := read()
+		d.mutex.Unlock()
+		if newState != state {
+			state = newState
+			d.log.Debug(name, " ", state)
 			ch <- newState
 		}
 	}
 }
 
+// StopButtonListener should be spawned as a goroutine, and will trigger on press and release
+func (d *Driver) StopButtonListener(ch chan<- bool) {
+	d.switchListener(func() bool { return d.elev.StopSignal() }, "Stop button pressed:", ch)
+}
+
+// ObstructionListener should be spawned as a goroutine, and will trigger when the door gets or stops being obstructed
+func (d *Driver) ObstructionListener(ch chan<- bool) {
+	d.switchListener(func() bool { return d.elev.ObstructionSignal() }, "Obstruction:", ch)
+}
+
 // FloorButtonListener should be spawned as a goroutine
-func FloorButtonListener(ch chan<- ButtonEvent) {
-	var floorButtonState [3][NumFloors]bool
+func (d *Driver) FloorButtonListener(ch chan<- ButtonEvent) {
+	var floorButtonState [3][]bool
+	for i := range floorButtonState {
+		floorButtonState[i] = make([]bool, d.numFloors)
+	}
 
 	for {
+		time.Sleep(pollInterval)
 		for direction := DirectionUp; direction <= DirectionNone; direction++ {
-			for floor := Floor(0); floor < NumFloors; floor++ {
-				mutex.Lock()
-				newState := C.elev_get_button_signal(C.elev_button_type_t(direction), C.int(floor)) != 0
-				mutex.Unlock()
+			for floor := Floor(0); floor < d.numFloors; floor++ {
+				d.mutex.Lock()
+				newState := d.elev.ButtonSignal(direction, floor)
+				d.mutex.Unlock()
 				if newState != floorButtonState[direction][floor] {
 					floorButtonState[direction][floor] = newState
 
 					// Only dispatch an event if it's pressed
 					if newState {
-						log.Debug("Button type ", direction, " floor ", floor, " pressed")
+						d.log.With("floor", floor, "dir", direction).Debug("Button type ", direction, " floor ", floor, " pressed")
 						ch <- ButtonEvent{Dir: direction, Floor: floor}
 					} else {
-						log.Bullshit("Button type ", direction, " floor ", floor, " released")
+						d.log.With("floor", floor, "dir", direction).Bullshit("Button type ", direction, " floor ", floor, " released")
 					}
 				}
 			}
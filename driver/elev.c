@@ -1,3 +1,5 @@
+//go:build comedi
+
 
 
 #include "elev.h"
@@ -0,0 +1,61 @@
+package driver
+
+import "fmt"
+
+// MotorDirection as understood by the hardware
+type MotorDirection int8
+
+// enum definitions for motor direction, matches elev_motor_direction_t
+const (
+	MotorDown MotorDirection = -1
+	MotorStop MotorDirection = 0
+	MotorUp   MotorDirection = 1
+)
+
+// Elevator is the hardware abstraction the driver runs on top of.
+// Buttons are indexed by Direction, where DirectionNone is the command button inside the car.
+// Implementations do not have to be thread safe, the driver serializes all calls.
+type Elevator interface {
+	Init() error
+
+	SetMotorDirection(dir MotorDirection)
+	SetButtonLamp(button Direction, floor Floor, on bool)
+	SetFloorIndicator(floor Floor)
+	SetDoorOpenLamp(on bool)
+	SetStopLamp(on bool)
+
+	ButtonSignal(button Direction, floor Floor) bool
+	FloorSensorSignal() Floor // -1 if between floors
+	StopSignal() bool
+	ObstructionSignal() bool
+}
+
+// Backends compiled into this binary, registered from init() in each backend's file.
+// addr is only used by backends that connect somewhere. Backends that can't have the given
+// number of floors must refuse.
+var backends = map[string]func(addr string, floors Floor) (Elevator, error){}
+
+func register(name string, open func(addr string, floors Floor) (Elevator, error)) {
+	backends[name] = open
+}
+
+// defaultBackend is the lab hardware when compiled in, else the elevator server
+var defaultBackend = "tcp"
+
+// DefaultBackend is the backend to use if nothing else is said: comedi when built with -tags comedi,
+// tcp otherwise
+func DefaultBackend() string {
+	return defaultBackend
+}
+
+// Open returns the backend with the given name
+func Open(name, addr string, floors Floor) (Elevator, error) {
+	open, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("driver: backend %q is not compiled into this binary", name)
+	}
+	if floors < 2 {
+		return nil, fmt.Errorf("driver: an elevator needs at least 2 floors, not %d", floors)
+	}
+	return open(addr, floors)
+}
@@ -1,3 +1,5 @@
+//go:build comedi
+
 #include <comedilib.h>
 
 #include "io.h"
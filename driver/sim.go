@@ -0,0 +1,252 @@
+package driver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knutaldrin/elevator/log"
+)
+
+// Sim is an in-process simulated elevator car, a drop-in for the lab hardware.
+// The car position is integrated lazily from the motor direction every time the sim is touched.
+type Sim struct {
+	// TravelTime is the time it takes to move one floor
+	TravelTime time.Duration
+	// SensorWindow is how much of a floor (0-1) around each floor the floor sensor is active for
+	SensorWindow float64
+	// PressTime is how long a simulated button press is held
+	PressTime time.Duration
+
+	mu sync.Mutex
+
+	pos   float64 // in floors, 0 is the bottom floor
+	motor MotorDirection
+	since time.Time
+
+	floors  Floor
+	pressed [3][]time.Time
+	lamps   [3][]bool
+
+	floorIndicator   Floor
+	door, stopLamp   bool
+	stop, obstructed bool
+}
+
+func init() {
+	register("sim", func(addr string, floors Floor) (Elevator, error) { return NewSim(floors), nil })
+}
+
+// NewSim makes a simulated car, parked between the two bottom floors like after a power cut
+func NewSim(floors Floor) *Sim {
+	s := &Sim{
+		TravelTime:   2 * time.Second,
+		SensorWindow: 0.1,
+		PressTime:    100 * time.Millisecond,
+		floors:       floors,
+		pos:          0.5,
+		since:        time.Now(),
+	}
+	for i := range s.lamps {
+		s.pressed[i] = make([]time.Time, floors)
+		s.lamps[i] = make([]bool, floors)
+	}
+	return s
+}
+
+// advance moves the car according to the motor since last time. Must hold mu.
+func (s *Sim) advance() {
+	now := time.Now()
+	s.pos += float64(s.motor) * float64(now.Sub(s.since)) / float64(s.TravelTime)
+	s.since = now
+
+	// End stops cut the motor
+	if s.pos < 0 {
+		s.pos = 0
+		s.motor = MotorStop
+		log.Warning("Sim: car hit the bottom of the shaft")
+	} else if s.pos > float64(s.floors-1) {
+		s.pos = float64(s.floors - 1)
+		s.motor = MotorStop
+		log.Warning("Sim: car hit the top of the shaft")
+	}
+}
+
+// Init resets all lamps, like elev_init
+func (s *Sim) Init() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+	for i := range s.lamps {
+		s.lamps[i] = make([]bool, s.floors)
+	}
+	s.stopLamp = false
+	s.door = false
+	s.floorIndicator = 0
+	return nil
+}
+
+// SetMotorDirection starts or stops the car
+func (s *Sim) SetMotorDirection(dir MotorDirection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+	s.motor = dir
+}
+
+// SetButtonLamp sets a button lamp
+func (s *Sim) SetButtonLamp(button Direction, floor Floor, on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lamps[button][floor] = on
+}
+
+// SetFloorIndicator sets the floor indicator
+func (s *Sim) SetFloorIndicator(floor Floor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.floorIndicator = floor
+}
+
+// SetDoorOpenLamp sets the door open lamp
+func (s *Sim) SetDoorOpenLamp(on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.door = on
+}
+
+// SetStopLamp sets the stop lamp
+func (s *Sim) SetStopLamp(on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopLamp = on
+}
+
+// ButtonSignal is true while a button is held
+func (s *Sim) ButtonSignal(button Direction, floor Floor) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.pressed[button][floor]) < s.PressTime
+}
+
+// FloorSensorSignal gives the floor if the car is within the sensor window, -1 otherwise
+func (s *Sim) FloorSensorSignal() Floor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+	nearest := math.Floor(s.pos + 0.5)
+	if math.Abs(s.pos-nearest) <= s.SensorWindow/2 {
+		return Floor(nearest)
+	}
+	return -1
+}
+
+// StopSignal is true while the stop button is held
+func (s *Sim) StopSignal() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stop
+}
+
+// ObstructionSignal is true while the obstruction switch is on
+func (s *Sim) ObstructionSignal() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.obstructed
+}
+
+// Press pushes a button for PressTime
+func (s *Sim) Press(button Direction, floor Floor) {
+	if button > DirectionNone || floor < 0 || floor >= s.floors {
+		log.Warning("Sim: no such button")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pressed[button][floor] = time.Now()
+}
+
+// SetStop holds or releases the stop button
+func (s *Sim) SetStop(pressed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stop = pressed
+}
+
+// SetObstruction flips the obstruction switch
+func (s *Sim) SetObstruction(on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.obstructed = on
+}
+
+// String draws the car state on one line
+func (s *Sim) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "pos %.2f motor %2d ind %d door %t stop %t/%t obstr %t |", s.pos, s.motor, s.floorIndicator, s.door, s.stop, s.stopLamp, s.obstructed)
+	for f := Floor(0); f < s.floors; f++ {
+		b.WriteString(" ")
+		for btn, c := range "^vc" {
+			if s.lamps[btn][f] {
+				b.WriteRune(c)
+			} else {
+				b.WriteRune('-')
+			}
+		}
+	}
+	return b.String()
+}
+
+// ReadCommands operates the sim from text, one command per line. See Command.
+func (s *Sim) ReadCommands(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		s.Command(scanner.Text())
+	}
+}
+
+// Command operates the sim from a line of text:
+//
+//	u <floor>  call up
+//	d <floor>  call down
+//	c <floor>  cab button
+//	s          toggle stop button
+//	o          toggle obstruction
+//	p          print state
+func (s *Sim) Command(line string) {
+	var cmd string
+	var floor Floor
+	n, _ := fmt.Sscan(line, &cmd, &floor)
+	if n == 0 {
+		return
+	}
+
+	switch {
+	case cmd == "u" && n == 2:
+		s.Press(DirectionUp, floor)
+	case cmd == "d" && n == 2:
+		s.Press(DirectionDown, floor)
+	case cmd == "c" && n == 2:
+		s.Press(DirectionNone, floor)
+	case cmd == "s":
+		s.mu.Lock()
+		s.stop = !s.stop
+		s.mu.Unlock()
+	case cmd == "o":
+		s.mu.Lock()
+		s.obstructed = !s.obstructed
+		s.mu.Unlock()
+	case cmd == "p":
+		log.Text(s.String())
+	default:
+		log.Warning("Sim: unknown command ", line)
+	}
+}
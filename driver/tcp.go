@@ -0,0 +1,234 @@
+package driver
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/knutaldrin/elevator/log"
+)
+
+/** ELEVATOR SERVER PROTOCOL
+ * Same as the lab's simulator/ElevatorServer. Always 4 bytes, both ways.
+ *
+ * 1: set motor direction  [1, dir (int8), 0, 0]
+ * 2: set button lamp      [2, button, floor, value]
+ * 3: set floor indicator  [3, floor, 0, 0]
+ * 4: set door open lamp   [4, value, 0, 0]
+ * 5: set stop lamp        [5, value, 0, 0]
+ * 6: get button signal    [6, button, floor, 0] -> [6, pressed, 0, 0]
+ * 7: get floor sensor     [7, 0, 0, 0]          -> [7, at floor, floor, 0]
+ * 8: get stop signal      [8, 0, 0, 0]          -> [8, pressed, 0, 0]
+ * 9: get obstruction      [9, 0, 0, 0]          -> [9, active, 0, 0]
+ */
+
+const (
+	cmdMotorDirection byte = iota + 1
+	cmdButtonLamp
+	cmdFloorIndicator
+	cmdDoorOpenLamp
+	cmdStopLamp
+	cmdButtonSignal
+	cmdFloorSensor
+	cmdStopSignal
+	cmdObstruction
+)
+
+// DefaultServerAddr is where the lab ElevatorServer listens by default
+const DefaultServerAddr = "localhost:15657"
+
+// Don't hammer a dead server from the listeners
+const redialDelay = time.Second
+
+func init() {
+	register("tcp", func(addr string, floors Floor) (Elevator, error) {
+		if addr == "" {
+			addr = DefaultServerAddr
+		}
+		return &tcpElevator{addr: addr, floors: floors}, nil
+	})
+}
+
+// tcpElevator is a client for an elevator server
+type tcpElevator struct {
+	addr     string
+	floors   Floor
+	conn     net.Conn
+	lastDial time.Time
+}
+
+func b2byte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (t *tcpElevator) dial() error {
+	t.lastDial = time.Now()
+	conn, err := net.DialTimeout("tcp", t.addr, redialDelay)
+	if err != nil {
+		return err
+	}
+	t.conn = conn
+	return nil
+}
+
+// transfer sends a command, and reads the reply if wanted. On error the connection is dropped and redialed later.
+func (t *tcpElevator) transfer(cmd [4]byte, reply bool) (res [4]byte) {
+	if t.conn == nil {
+		if time.Since(t.lastDial) < redialDelay {
+			return
+		}
+		if err := t.dial(); err != nil {
+			log.Error("Elevator server: ", err)
+			return
+		}
+		log.Info("Reconnected to elevator server at ", t.addr)
+	}
+
+	_, err := t.conn.Write(cmd[:])
+	if err == nil && reply {
+		_, err = io.ReadFull(t.conn, res[:])
+	}
+	if err != nil {
+		log.Error("Elevator server: ", err)
+		t.conn.Close()
+		t.conn = nil
+		res = [4]byte{}
+	}
+	return
+}
+
+func (t *tcpElevator) Init() error {
+	if err := t.dial(); err != nil {
+		return err
+	}
+	for f := Floor(0); f < t.floors; f++ {
+		for b := DirectionUp; b <= DirectionNone; b++ {
+			t.SetButtonLamp(b, f, false)
+		}
+	}
+	t.SetStopLamp(false)
+	t.SetDoorOpenLamp(false)
+	t.SetFloorIndicator(0)
+	return nil
+}
+
+func (t *tcpElevator) SetMotorDirection(dir MotorDirection) {
+	t.transfer([4]byte{cmdMotorDirection, byte(dir)}, false)
+}
+
+func (t *tcpElevator) SetButtonLamp(button Direction, floor Floor, on bool) {
+	t.transfer([4]byte{cmdButtonLamp, byte(button), byte(floor), b2byte(on)}, false)
+}
+
+func (t *tcpElevator) SetFloorIndicator(floor Floor) {
+	t.transfer([4]byte{cmdFloorIndicator, byte(floor)}, false)
+}
+
+func (t *tcpElevator) SetDoorOpenLamp(on bool) {
+	t.transfer([4]byte{cmdDoorOpenLamp, b2byte(on)}, false)
+}
+
+func (t *tcpElevator) SetStopLamp(on bool) {
+	t.transfer([4]byte{cmdStopLamp, b2byte(on)}, false)
+}
+
+func (t *tcpElevator) ButtonSignal(button Direction, floor Floor) bool {
+	return t.transfer([4]byte{cmdButtonSignal, byte(button), byte(floor)}, true)[1] != 0
+}
+
+func (t *tcpElevator) FloorSensorSignal() Floor {
+	res := t.transfer([4]byte{cmdFloorSensor}, true)
+	if res[1] == 0 {
+		return -1
+	}
+	return Floor(res[2])
+}
+
+func (t *tcpElevator) StopSignal() bool {
+	return t.transfer([4]byte{cmdStopSignal}, true)[1] != 0
+}
+
+func (t *tcpElevator) ObstructionSignal() bool {
+	return t.transfer([4]byte{cmdObstruction}, true)[1] != 0
+}
+
+// ServeTCP serves any backend with the elevator server protocol. Blocks until the listener fails.
+// Clients are served concurrently, but calls into e are serialized. Commands for floors outside
+// the building are ignored.
+func ServeTCP(l net.Listener, e Elevator, floors Floor) error {
+	mu := &sync.Mutex{}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		log.Info("Elevator client connected from ", conn.RemoteAddr())
+		go serveConn(conn, e, floors, mu)
+	}
+}
+
+func serveConn(conn net.Conn, e Elevator, floors Floor, mu *sync.Mutex) {
+	defer conn.Close()
+
+	var cmd [4]byte
+	for {
+		if _, err := io.ReadFull(conn, cmd[:]); err != nil {
+			if err != io.EOF {
+				log.Warning("Elevator client ", conn.RemoteAddr(), ": ", err)
+			}
+			log.Info("Elevator client disconnected from ", conn.RemoteAddr())
+			return
+		}
+
+		button, floor := Direction(cmd[1]), Floor(cmd[2])
+		validButton := button <= DirectionNone && floor < floors
+
+		mu.Lock()
+		res := [4]byte{cmd[0]}
+		reply := false
+		switch cmd[0] {
+		case cmdMotorDirection:
+			e.SetMotorDirection(MotorDirection(int8(cmd[1])))
+		case cmdButtonLamp:
+			if validButton {
+				e.SetButtonLamp(button, floor, cmd[3] != 0)
+			}
+		case cmdFloorIndicator:
+			if Floor(cmd[1]) < floors {
+				e.SetFloorIndicator(Floor(cmd[1]))
+			}
+		case cmdDoorOpenLamp:
+			e.SetDoorOpenLamp(cmd[1] != 0)
+		case cmdStopLamp:
+			e.SetStopLamp(cmd[1] != 0)
+		case cmdButtonSignal:
+			reply = true
+			res[1] = b2byte(validButton && e.ButtonSignal(button, floor))
+		case cmdFloorSensor:
+			reply = true
+			if f := e.FloorSensorSignal(); f >= 0 {
+				res[1], res[2] = 1, byte(f)
+			}
+		case cmdStopSignal:
+			reply = true
+			res[1] = b2byte(e.StopSignal())
+		case cmdObstruction:
+			reply = true
+			res[1] = b2byte(e.ObstructionSignal())
+		default:
+			log.Bullshit("Elevator client sent unknown command ", cmd[0])
+		}
+		mu.Unlock()
+
+		if reply {
+			if _, err := conn.Write(res[:]); err != nil {
+				log.Warning("Elevator client ", conn.RemoteAddr(), ": ", err)
+				return
+			}
+		}
+	}
+}
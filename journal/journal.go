@@ -0,0 +1,313 @@
+// Package journal is an append-only file of checksummed records. Appends are cheap and a crash can only
+// lose the record being written, which is dropped on the next open. Anything else that doesn't check out
+// is corruption, and the journal is refused. Compact rewrites the journal with only the records still
+// worth keeping.
+package journal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/knutaldrin/elevator/log"
+	"github.com/knutaldrin/elevator/store"
+)
+
+/** FILE FORMAT
+ * 4 bytes: magic, "ELVJ"
+ * 2 bytes: schema version of the records, see Options
+ * Then records, each:
+ * 2 bytes: length of the data
+ * n bytes: data
+ * 4 bytes: CRC-32C of the length and data
+ */
+
+var magic = []byte("ELVJ")
+
+const headerLen = 4 + 2
+
+// MaxRecord is the longest record
+const MaxRecord = 0xffff
+
+const frameLen = 2 + 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// SyncPolicy is when appends are flushed to disk. Every append reaches the OS at once and survives the
+// process crashing, syncing is what makes it survive the machine going down.
+type SyncPolicy int
+
+// enum definitions for sync policies
+const (
+	SyncAlways   SyncPolicy = iota // fsync every append before returning
+	SyncInterval                   // fsync in the background every Options.Interval, if anything was appended
+	SyncNever                      // leave it to the OS
+)
+
+// ParseSyncPolicy reads always, interval or never
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	}
+	return 0, fmt.Errorf("unknown sync policy %s, expected always, interval or never", s)
+}
+
+// Options for opening a journal
+type Options struct {
+	// Schema version of the records. A journal written with another one is refused.
+	Schema uint16
+	Sync   SyncPolicy
+	// Interval between syncs with SyncInterval. Zero for DefaultSyncInterval.
+	Interval time.Duration
+}
+
+// DefaultSyncInterval is how often SyncInterval syncs by default
+const DefaultSyncInterval = 100 * time.Millisecond
+
+// Journal is an open journal file. Safe for concurrent use.
+type Journal struct {
+	path string
+	opts Options
+
+	mutex   sync.Mutex
+	file    *os.File
+	records int  // in the file
+	dirty   bool // appended since the last sync
+	closed  chan struct{}
+}
+
+// Open opens the journal at path, or creates it, and gives the records in it, oldest first.
+// A torn record at the end, from crashing mid-append, is dropped. A corrupt journal, or one of
+// another schema version, gives a store.CorruptError.
+func Open(path string, opts Options) (*Journal, [][]byte, error) {
+	if opts.Interval == 0 {
+		opts.Interval = DefaultSyncInterval
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+	records, end, err := read(file, opts.Schema)
+	if err != nil {
+		file.Close()
+		if reason, ok := err.(corruption); ok {
+			return nil, nil, &store.CorruptError{Path: path, Reason: string(reason)}
+		}
+		return nil, nil, err
+	}
+
+	// Cut whatever didn't parse, so appends go after the last good record
+	size, err := file.Seek(0, io.SeekEnd)
+	if err == nil && size != end {
+		log.Warning("Journal ", path, ": dropping ", size-end, " bytes of torn record at the end")
+		err = file.Truncate(end)
+	}
+	if err == nil && end == 0 {
+		_, err = file.Write(header(opts.Schema))
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekEnd)
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	j := &Journal{path: path, opts: opts, file: file, records: len(records), closed: make(chan struct{})}
+	if opts.Sync == SyncInterval {
+		go j.syncLoop()
+	}
+	return j, records, nil
+}
+
+// corruption is why a journal can't be trusted
+type corruption string
+
+func (c corruption) Error() string { return string(c) }
+
+func header(schema uint16) []byte {
+	return binary.BigEndian.AppendUint16(append([]byte(nil), magic...), schema)
+}
+
+// read the records in the file. Gives the offset after the last good one, 0 for an empty file.
+func read(file *os.File, schema uint16) ([][]byte, int64, error) {
+	buf, err := io.ReadAll(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(buf) == 0 {
+		return nil, 0, nil
+	}
+	if len(buf) < headerLen || !bytes.Equal(buf[:len(magic)], magic) {
+		return nil, 0, corruption("not a journal")
+	}
+	if v := binary.BigEndian.Uint16(buf[len(magic):]); v != schema {
+		return nil, 0, corruption(fmt.Sprintf("schema version %d, expected %d", v, schema))
+	}
+
+	var records [][]byte
+	off := headerLen
+	for off < len(buf) {
+		if off+frameLen > len(buf) {
+			break // Torn
+		}
+		n := int(binary.BigEndian.Uint16(buf[off:]))
+		end := off + frameLen + n
+		if end > len(buf) {
+			// Torn, unless the length is garbage and there are good records after it
+			if frameAfter(buf, off+1) {
+				return nil, 0, corruption(fmt.Sprintf("bad length of record %d at offset %d", len(records)+1, off))
+			}
+			break
+		}
+		frame := buf[off : off+2+n]
+		if crc32.Checksum(frame, crcTable) != binary.BigEndian.Uint32(buf[off+2+n:]) {
+			if end == len(buf) {
+				break // Torn, the last record was only partly written
+			}
+			return nil, 0, corruption(fmt.Sprintf("bad checksum of record %d at offset %d", len(records)+1, off))
+		}
+		records = append(records, append([]byte(nil), frame[2:]...))
+		off = end
+	}
+	return records, int64(off), nil
+}
+
+// frameAfter tells if a whole record with a good checksum starts anywhere from off. A torn append is
+// part of one record, so it has none.
+func frameAfter(buf []byte, off int) bool {
+	for ; off+frameLen <= len(buf); off++ {
+		n := int(binary.BigEndian.Uint16(buf[off:]))
+		end := off + frameLen + n
+		if end <= len(buf) && crc32.Checksum(buf[off:off+2+n], crcTable) == binary.BigEndian.Uint32(buf[off+2+n:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func frame(data []byte) []byte {
+	buf := binary.BigEndian.AppendUint16(make([]byte, 0, frameLen+len(data)), uint16(len(data)))
+	buf = append(buf, data...)
+	return binary.BigEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+}
+
+// Append a record
+func (j *Journal) Append(data []byte) error {
+	if len(data) > MaxRecord {
+		return fmt.Errorf("record of %d bytes is too long", len(data))
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.file == nil {
+		return errors.New("journal is closed")
+	}
+	if _, err := j.file.Write(frame(data)); err != nil {
+		return err
+	}
+	j.records++
+	if j.opts.Sync == SyncAlways {
+		return j.file.Sync()
+	}
+	j.dirty = true
+	return nil
+}
+
+// Len is the number of records in the file, kept or not
+func (j *Journal) Len() int {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.records
+}
+
+// Compact replaces everything in the journal with the given records. The new journal is written next to
+// the old one and renamed over it, so a crash leaves one or the other.
+func (j *Journal) Compact(records [][]byte) error {
+	buf := header(j.opts.Schema)
+	for _, r := range records {
+		if len(r) > MaxRecord {
+			return fmt.Errorf("record of %d bytes is too long", len(r))
+		}
+		buf = append(buf, frame(r)...)
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.file == nil {
+		return errors.New("journal is closed")
+	}
+
+	if err := store.WriteFile(j.path, buf); err != nil {
+		return err
+	}
+
+	// The old file is gone, appends go to the new one from now on
+	j.file.Close()
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		j.file = nil
+		close(j.closed)
+		return err
+	}
+	j.file = file
+	j.records = len(records)
+	j.dirty = false
+	log.Debug("Journal ", j.path, " compacted to ", len(records), " records")
+	return nil
+}
+
+// Sync flushes appends to disk
+func (j *Journal) Sync() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.file == nil || !j.dirty {
+		return nil
+	}
+	j.dirty = false
+	return j.file.Sync()
+}
+
+func (j *Journal) syncLoop() {
+	ticker := time.NewTicker(j.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := j.Sync(); err != nil {
+				log.Error("Journal ", j.path, ": ", err)
+			}
+		case <-j.closed:
+			return
+		}
+	}
+}
+
+// Close syncs and closes the journal
+func (j *Journal) Close() error {
+	err := j.Sync()
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.file == nil {
+		return err
+	}
+	close(j.closed)
+	if cerr := j.file.Close(); err == nil {
+		err = cerr
+	}
+	j.file = nil
+	return err
+}
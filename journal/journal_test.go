@@ -0,0 +1,157 @@
+package journal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/knutaldrin/elevator/store"
+)
+
+func open(t *testing.T, path string) (*Journal, [][]byte) {
+	j, records, err := Open(path, Options{Schema: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j, records
+}
+
+func appendAll(t *testing.T, j *Journal, records ...[]byte) {
+	for _, r := range records {
+		if err := j.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func closeJournal(t *testing.T, j *Journal) {
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var testRecords = [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{0xa5}, MaxRecord)}
+
+// same records, an empty one being as good as nil
+func same(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, records := open(t, path)
+	if len(records) != 0 {
+		t.Fatalf("new journal has %d records", len(records))
+	}
+	appendAll(t, j, testRecords...)
+	if err := j.Append(make([]byte, MaxRecord+1)); err == nil {
+		t.Fatal("appended a record too long")
+	}
+	closeJournal(t, j)
+
+	j, records = open(t, path)
+	defer j.Close()
+	if !same(records, testRecords) {
+		t.Fatalf("read %d records back, not what was appended", len(records))
+	}
+	if j.Len() != len(testRecords) {
+		t.Fatalf("Len is %d, expected %d", j.Len(), len(testRecords))
+	}
+}
+
+func TestTornTailIsDropped(t *testing.T) {
+	tears := map[string]func([]byte) []byte{
+		"partial length": func(f []byte) []byte { return f[:1] },
+		"partial data":   func(f []byte) []byte { return f[:len(f)-5] },
+		"bad checksum":   func(f []byte) []byte { f[len(f)-1]++; return f },
+	}
+	for name, tear := range tears {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "journal")
+			j, _ := open(t, path)
+			appendAll(t, j, testRecords[:2]...)
+			closeJournal(t, j)
+
+			good, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, append(good, tear(frame([]byte("torn")))...), 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			j, records := open(t, path)
+			if !same(records, testRecords[:2]) {
+				t.Fatalf("read %q, expected the records before the torn one", records)
+			}
+			appendAll(t, j, []byte("after"))
+			closeJournal(t, j)
+
+			j, records = open(t, path)
+			defer j.Close()
+			if len(records) != 3 || string(records[2]) != "after" {
+				t.Fatalf("read %q, expected the record appended after the torn one", records)
+			}
+		})
+	}
+}
+
+func TestCorruptionIsRefused(t *testing.T) {
+	corruptions := map[string]func([]byte) []byte{
+		"not a journal":   func(buf []byte) []byte { buf[0] = 'X'; return buf },
+		"short header":    func(buf []byte) []byte { return buf[:3] },
+		"other schema":    func(buf []byte) []byte { buf[5]++; return buf },
+		"record checksum": func(buf []byte) []byte { buf[headerLen+2]++; return buf },
+		"record length":   func(buf []byte) []byte { buf[headerLen] = 0xff; return buf },
+	}
+	for name, corrupt := range corruptions {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "journal")
+			j, _ := open(t, path)
+			appendAll(t, j, []byte("first"), []byte("second"), []byte("third"))
+			closeJournal(t, j)
+
+			buf, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, corrupt(buf), 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			_, records, err := Open(path, Options{Schema: 3})
+			if _, ok := err.(*store.CorruptError); !ok {
+				t.Fatalf("gave %q, %v, expected a CorruptError", records, err)
+			}
+		})
+	}
+}
+
+func TestCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, _ := open(t, path)
+	appendAll(t, j, []byte("a"), []byte("b"), []byte("c"), []byte("d"))
+	if err := j.Compact([][]byte{[]byte("b"), []byte("d")}); err != nil {
+		t.Fatal(err)
+	}
+	if j.Len() != 2 {
+		t.Fatalf("Len is %d after compacting, expected 2", j.Len())
+	}
+	appendAll(t, j, []byte("e"))
+	closeJournal(t, j)
+
+	j, records := open(t, path)
+	defer j.Close()
+	if want := [][]byte{[]byte("b"), []byte("d"), []byte("e")}; !same(records, want) {
+		t.Fatalf("read %q, expected %q", records, want)
+	}
+}
@@ -0,0 +1,267 @@
+package log
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/** LOG FILE SEGMENTS, next to the file
+ * <file>                                   being written
+ * <file>.20061018T093114.123               rotated, named for when
+ * <file>.20061018T093114.123.gz            rotated and compressed
+ * <file>.20061018T093114.123.gz-partial    being compressed
+ */
+
+const segmentStamp = "20060102T150405.000"
+
+// FileOptions for a log file
+type FileOptions struct {
+	// Level of messages that go to the file, whatever the console gets
+	Level  Level
+	Format Format
+	// MaxSize rotates the file before it grows past this many bytes. Zero for no limit.
+	MaxSize int64
+	// MaxAge rotates the file once its first line is this old. Zero for no limit.
+	MaxAge time.Duration
+	// Keep this many rotated segments, deleting older ones. Zero keeps them all.
+	Keep int
+	// Compress rotated segments with gzip
+	Compress bool
+}
+
+// File is a log file that rotates itself. Rotated segments are compressed and pruned in the background.
+type File struct {
+	path string
+	opts FileOptions
+
+	mutex   sync.Mutex
+	file    *os.File
+	size    int64
+	started time.Time // First line written, or for a file we reopened, the last: it's at least that old
+	failing bool      // Last write failed, and we said so
+
+	kick    chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// OpenFile opens the log file at path for appending, creating it and its directory if needed.
+// Segments left uncompressed by a crash are compressed.
+func OpenFile(path string, opts FileOptions) (*File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	f := &File{
+		path:    path,
+		opts:    opts,
+		file:    file,
+		size:    info.Size(),
+		started: info.ModTime(),
+		kick:    make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go f.housekeep()
+	f.kick <- struct{}{}
+	return f, nil
+}
+
+// Path of the file being written
+func (f *File) Path() string {
+	return f.path
+}
+
+// Write appends to the file, rotating it first if it is due
+func (f *File) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return 0, errors.New("log file is closed")
+	}
+
+	if f.size > 0 && ((f.opts.MaxSize > 0 && f.size+int64(len(p)) > f.opts.MaxSize) ||
+		(f.opts.MaxAge > 0 && time.Since(f.started) >= f.opts.MaxAge)) {
+		f.rotate()
+	}
+	if f.size == 0 {
+		f.started = time.Now()
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	// Can't log that logging failed, so stderr it is. Once, not for every message.
+	if err != nil && !f.failing {
+		fmt.Fprintln(os.Stderr, "Writing log file", f.path+":", err)
+	}
+	f.failing = err != nil
+	return n, err
+}
+
+// rotate moves the file aside and starts a new one. Must hold mutex. If it can't, we go on writing
+// where we were, better a big file than no log.
+func (f *File) rotate() {
+	// Names are by the millisecond, rotating faster than that takes the next free one
+	at := time.Now()
+	segment := f.path + "." + at.Format(segmentStamp)
+	for exists(segment) || exists(segment+".gz") {
+		at = at.Add(time.Millisecond)
+		segment = f.path + "." + at.Format(segmentStamp)
+	}
+
+	if err := os.Rename(f.path, segment); err != nil {
+		fmt.Fprintln(os.Stderr, "Rotating log file", f.path+":", err)
+		return
+	}
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Rotating log file", f.path+":", err)
+		return
+	}
+	f.file.Close()
+	f.file, f.size = file, 0
+
+	select {
+	case f.kick <- struct{}{}:
+	default: // Already kicked, it'll see this one too
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// housekeep compresses and prunes rotated segments whenever kicked, until closed
+func (f *File) housekeep() {
+	defer close(f.done)
+	for {
+		select {
+		case <-f.kick:
+			f.tidy()
+		case <-f.closing:
+			return
+		}
+	}
+}
+
+// tidy compresses the rotated segments not compressed yet, and deletes the oldest ones we don't keep
+func (f *File) tidy() {
+	dir, base := filepath.Dir(f.path), filepath.Base(f.path)+"."
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		Warning("Tidying log files: ", err)
+		return
+	}
+
+	var segments []string // oldest first, as the names sort by time
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, base) {
+			continue
+		}
+		rest := name[len(base):]
+		if strings.HasSuffix(rest, ".gz-partial") {
+			// Left behind by crashing mid-compression, the segment is still there
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if _, err := time.Parse(segmentStamp, strings.TrimSuffix(rest, ".gz")); err != nil {
+			continue // Not ours
+		}
+		segments = append(segments, filepath.Join(dir, name))
+	}
+	sort.Strings(segments)
+
+	if f.opts.Keep > 0 && len(segments) > f.opts.Keep {
+		for _, segment := range segments[:len(segments)-f.opts.Keep] {
+			if err := os.Remove(segment); err != nil {
+				Warning("Deleting old log file: ", err)
+			}
+		}
+		segments = segments[len(segments)-f.opts.Keep:]
+	}
+
+	if !f.opts.Compress {
+		return
+	}
+	for _, segment := range segments {
+		if strings.HasSuffix(segment, ".gz") {
+			continue
+		}
+		if err := compress(segment); err != nil {
+			Warning("Compressing log file: ", err)
+		}
+	}
+}
+
+// compress a segment to segment.gz, and delete it
+func compress(segment string) error {
+	src, err := os.Open(segment)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Not .tmp, which is what the store cleans up after
+	tmp := segment + ".gz-partial"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, segment+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(segment)
+}
+
+// Close the file. Compression under way is finished first.
+func (f *File) Close() error {
+	f.mutex.Lock()
+	if f.file == nil {
+		f.mutex.Unlock()
+		return nil
+	}
+	err := f.file.Sync()
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	f.file = nil
+	f.mutex.Unlock()
+
+	close(f.closing)
+	<-f.done
+	return err
+}
@@ -0,0 +1,59 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// segments of a log file, rotated and not
+func segments(t *testing.T, path string) []string {
+	found, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestAgeCountsFromFirstWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "elevator-1.log")
+
+	// Idle for a long time after opening, the first line is still new
+	f, err := OpenFile(path, FileOptions{MaxAge: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mutex.Lock()
+	f.started = time.Now().Add(-time.Hour)
+	f.mutex.Unlock()
+	if _, err := f.Write([]byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("second\n")); err != nil {
+		t.Fatal(err)
+	}
+	if found := segments(t, path); len(found) != 0 {
+		t.Fatalf("rotated %v before the first line was old", found)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopened, it's as old as its last line at least
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	f, err = OpenFile(path, FileOptions{MaxAge: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("third\n")); err != nil {
+		t.Fatal(err)
+	}
+	if found := segments(t, path); len(found) != 1 {
+		t.Fatalf("found %v, expected the old lines rotated", found)
+	}
+}
@@ -0,0 +1,73 @@
+package log
+
+import (
+	"flag"
+	"time"
+)
+
+type levelFlag struct{ l *Level }
+
+func (f levelFlag) String() string {
+	if f.l == nil {
+		return GetLevel().String()
+	}
+	return f.l.String()
+}
+
+func (f levelFlag) Set(s string) error {
+	l, err := ParseLevel(s)
+	if err != nil {
+		return err
+	}
+	if f.l == nil {
+		SetLevel(l)
+	} else {
+		*f.l = l
+	}
+	return nil
+}
+
+type formatFlag struct{}
+
+func (formatFlag) String() string { return Format(format.Load()).String() }
+
+func (formatFlag) Set(s string) error {
+	f, err := ParseFormat(s)
+	if err == nil {
+		SetFormat(f)
+	}
+	return err
+}
+
+// The log file asked for on the command line
+var filePath string
+var fileOpts = FileOptions{Level: LevelDebug, MaxSize: 10 << 20, MaxAge: 24 * time.Hour, Keep: 10, Compress: true}
+
+// Flags adds -loglevel, -logformat and the log file flags to the command line flags. Call it before
+// flag.Parse, and Start after. The defaults for level and format are what the environment said.
+func Flags() {
+	flag.Var(levelFlag{}, "loglevel", "Log level: error, warning, info, debug or trace. SIGUSR1 turns it up, SIGUSR2 down")
+	flag.Var(formatFlag{}, "logformat", "Log format: text or json")
+	flag.BoolVar(&consoleOn, "logconsole", true, "Log to the console")
+	flag.StringVar(&filePath, "logfile", "", "Also log to this file, rotated and gzipped as it grows")
+	flag.Var(levelFlag{&fileOpts.Level}, "logfilelevel", "Log level of the log file, it doesn't follow the console")
+	flag.Int64Var(&fileOpts.MaxSize, "logmaxsize", fileOpts.MaxSize, "Rotate the log file before it grows past this many bytes, 0 for no limit")
+	flag.DurationVar(&fileOpts.MaxAge, "logmaxage", fileOpts.MaxAge, "Rotate the log file after this long, 0 for no limit")
+	flag.IntVar(&fileOpts.Keep, "logkeep", fileOpts.Keep, "Number of rotated log files to keep, 0 for all")
+}
+
+// Start opens the log file asked for by the flags, if any
+func Start() error {
+	updateMaxLevel() // -logconsole was set behind its back
+	if filePath == "" {
+		return nil
+	}
+	fileOpts.Format = Format(format.Load())
+	f, err := OpenFile(filePath, fileOpts)
+	if err != nil {
+		return err
+	}
+	AddFile(f)
+	Info("Logging to ", filePath, " at level ", fileOpts.Level)
+	return nil
+}
@@ -1,48 +1,390 @@
+// Package log writes leveled messages with key-value fields, as coloured text or as JSON lines, to the
+// console and to any log files added.
+//
+// The level is info unless $ELEVATOR_LOG_LEVEL says otherwise, and the format text unless
+// $ELEVATOR_LOG_FORMAT is json. Flags adds command line flags for both, and for a log file, and
+// HandleSignals lets SIGUSR1 and SIGUSR2 turn the console level up and down while running.
 package log
 
-import "fmt"
-import cli "github.com/ivpusic/go-clicolor/clicolor"
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-const debug = false
-const verbose = false
+	cli "github.com/ivpusic/go-clicolor/clicolor"
+)
+
+// Level of a message, or of what gets logged. Higher is chattier.
+type Level int32
+
+// enum definitions for levels
+const (
+	LevelError Level = iota
+	LevelWarning
+	LevelInfo
+	LevelDebug
+	LevelTrace
+)
+
+var levelNames = [...]string{"error", "warning", "info", "debug", "trace"}
+var levelColors = [...]string{"red", "yellow", "green", "blue", "magenta"}
+
+func (l Level) String() string {
+	if l < LevelError || l > LevelTrace {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel reads error, warning, info, debug or trace
+func ParseLevel(s string) (Level, error) {
+	s = strings.ToLower(s)
+	switch s {
+	case "warn":
+		return LevelWarning, nil
+	case "bullshit":
+		return LevelTrace, nil
+	}
+	for l, name := range levelNames {
+		if s == name {
+			return Level(l), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %s, expected error, warning, info, debug or trace", s)
+}
+
+// Format of the output
+type Format int32
+
+// enum definitions for formats
+const (
+	FormatText Format = iota // Coloured text, one line per message
+	FormatJSON               // One JSON object per line
+)
+
+// ParseFormat reads text or json
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "text":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return 0, fmt.Errorf("unknown log format %s, expected text or json", s)
+}
+
+func (f Format) String() string {
+	if f == FormatJSON {
+		return "json"
+	}
+	return "text"
+}
+
+// Environment variables giving the level and format at startup
+const (
+	LevelEnv  = "ELEVATOR_LOG_LEVEL"
+	FormatEnv = "ELEVATOR_LOG_FORMAT"
+)
+
+var level atomic.Int32
+var format atomic.Int32
+
+// maxLevel is the chattiest of the console and the files
+var maxLevel atomic.Int32
+
+// Serializes output, so messages from different goroutines don't end up in each other
+var outMutex sync.Mutex
+var consoleOn = true
+var files []*File
+
+func init() {
+	SetLevel(LevelInfo)
+	if s := os.Getenv(LevelEnv); s != "" {
+		if l, err := ParseLevel(s); err == nil {
+			SetLevel(l)
+		} else {
+			Warning(LevelEnv, ": ", err)
+		}
+	}
+	if s := os.Getenv(FormatEnv); s != "" {
+		if f, err := ParseFormat(s); err == nil {
+			SetFormat(f)
+		} else {
+			Warning(FormatEnv, ": ", err)
+		}
+	}
+}
+
+// SetLevel sets what gets logged to the console: messages of the level and below
+func SetLevel(l Level) {
+	level.Store(int32(l))
+	updateMaxLevel()
+}
+
+func updateMaxLevel() {
+	outMutex.Lock()
+	defer outMutex.Unlock()
+	max := GetLevel()
+	if !consoleOn {
+		max = LevelError - 1
+	}
+	for _, f := range files {
+		if f.opts.Level > max {
+			max = f.opts.Level
+		}
+	}
+	maxLevel.Store(int32(max))
+}
+
+// GetLevel is what gets logged to the console
+func GetLevel() Level {
+	return Level(level.Load())
+}
+
+// Enabled tells if messages of a level get logged anywhere, to skip building expensive ones
+func Enabled(l Level) bool {
+	return l <= Level(maxLevel.Load())
+}
+
+// SetFormat sets the output format
+func SetFormat(f Format) {
+	format.Store(int32(f))
+}
+
+// SetConsole turns logging to the console on or off
+func SetConsole(on bool) {
+	outMutex.Lock()
+	consoleOn = on
+	outMutex.Unlock()
+	updateMaxLevel()
+}
+
+// AddFile logs to a file too, at the file's level and format
+func AddFile(f *File) {
+	outMutex.Lock()
+	files = append(files, f)
+	outMutex.Unlock()
+	updateMaxLevel()
+}
+
+// Close the log files. Logging goes on to the console only.
+func Close() error {
+	outMutex.Lock()
+	closing := files
+	files = nil
+	outMutex.Unlock()
+	updateMaxLevel()
+
+	var err error
+	for _, f := range closing {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Logger adds key-value fields to every message it logs
+type Logger struct {
+	fields []interface{} // key, value, key, value...
+}
+
+var std = &Logger{}
+
+// With gives a logger adding fields to the messages, given as key, value, key, value...
+func With(kv ...interface{}) *Logger {
+	return std.With(kv...)
+}
+
+// With gives a logger adding more fields
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	return &Logger{fields: append(append(fields, l.fields...), kv...)}
+}
+
+// Error messages
+func (l *Logger) Error(msg ...interface{}) {
+	l.log(LevelError, msg)
+}
+
+// Check an error, if != then log Error
+func (l *Logger) Check(err error) {
+	if err != nil {
+		l.Error(err)
+	}
+}
+
+// Warning messages
+func (l *Logger) Warning(msg ...interface{}) {
+	l.log(LevelWarning, msg)
+}
+
+// Info is usually good
+func (l *Logger) Info(msg ...interface{}) {
+	l.log(LevelInfo, msg)
+}
+
+// Debug messages
+func (l *Logger) Debug(msg ...interface{}) {
+	l.log(LevelDebug, msg)
+}
+
+// Trace is what you need to follow every step
+func (l *Logger) Trace(msg ...interface{}) {
+	l.log(LevelTrace, msg)
+}
+
+// Bullshit that you usually don't want to hear. Same as Trace.
+func (l *Logger) Bullshit(msg ...interface{}) {
+	l.log(LevelTrace, msg)
+}
+
+func (l *Logger) log(lvl Level, msg []interface{}) {
+	if !Enabled(lvl) {
+		return
+	}
+	now := time.Now()
+	text := fmt.Sprint(msg...)
+
+	// Formatted once for whoever wants it
+	var lines [2][]byte
+	line := func(f Format) []byte {
+		if lines[f] == nil {
+			if f == FormatJSON {
+				lines[f] = formatJSON(now, lvl, text, l.fields)
+			} else {
+				lines[f] = formatText(now, lvl, text, l.fields)
+			}
+		}
+		return lines[f]
+	}
+
+	outMutex.Lock()
+	defer outMutex.Unlock()
+	if consoleOn && lvl <= GetLevel() {
+		if f := Format(format.Load()); f == FormatJSON {
+			fmt.Println(string(line(f)))
+		} else {
+			cli.Print(string(line(f))).In(levelColors[lvl])
+		}
+	}
+	for _, file := range files {
+		if lvl <= file.opts.Level {
+			// Failing is the file's to report
+			file.Write(append(line(file.opts.Format), '\n'))
+		}
+	}
+}
+
+/** TEXT FORMAT
+ * 2006-01-02 15:04:05.000 LEVEL   message key=value key="value with spaces"
+ */
+
+func formatText(now time.Time, lvl Level, text string, fields []interface{}) []byte {
+	buf := now.AppendFormat(nil, "2006-01-02 15:04:05.000")
+	buf = fmt.Appendf(buf, " %-7s %s", strings.ToUpper(lvl.String()), text)
+	for i := 0; i < len(fields); i += 2 {
+		buf = append(buf, ' ')
+		buf = append(buf, fmt.Sprint(fields[i])...)
+		buf = append(buf, '=')
+		if i+1 < len(fields) {
+			buf = appendTextValue(buf, fields[i+1])
+		}
+	}
+	return buf
+}
+
+func appendTextValue(buf []byte, v interface{}) []byte {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.AppendQuote(buf, s)
+	}
+	return append(buf, s...)
+}
+
+/** JSON FORMAT
+ * {"time":"2006-01-02T15:04:05.000000-07:00","level":"info","msg":"message","key":value,...}
+ * Values are JSON numbers, strings or booleans. Anything with a String or Error method is its string.
+ */
+
+func formatJSON(now time.Time, lvl Level, text string, fields []interface{}) []byte {
+	buf := append([]byte(`{"time":"`), now.Format("2006-01-02T15:04:05.000000Z07:00")...)
+	buf = append(buf, `","level":"`...)
+	buf = append(buf, lvl.String()...)
+	buf = append(buf, `","msg":`...)
+	buf = appendJSONValue(buf, text)
+	for i := 0; i < len(fields); i += 2 {
+		buf = append(buf, ',')
+		buf = appendJSONValue(buf, fmt.Sprint(fields[i]))
+		buf = append(buf, ':')
+		if i+1 < len(fields) {
+			buf = appendJSONValue(buf, fields[i+1])
+		} else {
+			buf = append(buf, "null"...)
+		}
+	}
+	return append(buf, '}')
+}
+
+func appendJSONValue(buf []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case error:
+		return appendJSONValue(buf, v.Error())
+	case fmt.Stringer:
+		return appendJSONValue(buf, v.String())
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return append(buf, b...)
+}
 
 // Error messages
 func Error(msg ...interface{}) {
-	cli.Print("ERROR: " + fmt.Sprint(msg...)).In("red")
+	std.log(LevelError, msg)
 }
 
 // Check an error, if != then log Error
 func Check(err error) {
 	if err != nil {
-		Error(err)
+		std.log(LevelError, []interface{}{err})
 	}
 }
 
 // Warning messages
 func Warning(msg ...interface{}) {
-	cli.Print("Warning: " + fmt.Sprint(msg...)).In("yellow")
+	std.log(LevelWarning, msg)
 }
 
 // Info is usually good
 func Info(msg ...interface{}) {
-	cli.Print(fmt.Sprint(msg...)).In("green")
+	std.log(LevelInfo, msg)
 }
 
-// Text is normal text
+// Text is normal text, printed as is whatever the level
 func Text(msg ...interface{}) {
-	fmt.Println(msg)
+	outMutex.Lock()
+	defer outMutex.Unlock()
+	fmt.Println(msg...)
 }
 
 // Debug messages
 func Debug(msg ...interface{}) {
-	if debug {
-		cli.Print(fmt.Sprint(msg...)).In("blue")
-	}
+	std.log(LevelDebug, msg)
 }
 
-// Bullshit that you usually don't want to hear
+// Trace is what you need to follow every step
+func Trace(msg ...interface{}) {
+	std.log(LevelTrace, msg)
+}
+
+// Bullshit that you usually don't want to hear. Same as Trace.
 func Bullshit(msg ...interface{}) {
-	if debug && verbose {
-		cli.Print(fmt.Sprint(msg...)).In("magenta")
-	}
+	std.log(LevelTrace, msg)
 }
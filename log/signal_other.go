@@ -0,0 +1,6 @@
+//go:build !unix
+
+package log
+
+// HandleSignals does nothing, there is no SIGUSR1 or SIGUSR2 here
+func HandleSignals() {}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package log
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// HandleSignals turns the level up a step on SIGUSR1 and down a step on SIGUSR2
+func HandleSignals() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range sigCh {
+			l := GetLevel()
+			if sig == syscall.SIGUSR1 && l < LevelTrace {
+				l++
+			} else if sig == syscall.SIGUSR2 && l > LevelError {
+				l--
+			}
+			SetLevel(l)
+			// Said even when turned down past it, or nobody would know it worked
+			say := LevelWarning
+			if l < say {
+				say = l
+			}
+			std.log(say, []interface{}{"Log level is now ", l})
+		}
+	}()
+}
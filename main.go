@@ -1,3 +1,6 @@
+// Command elevator runs one elevator. The lab hardware needs libcomedi and is only supported when built
+// with -tags comedi, e.g. go install -tags comedi github.com/knutaldrin/elevator. Without it the elevator
+// talks to an elevator server, or runs on simulated hardware.
 package main
 
 import (
@@ -7,117 +10,159 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/knutaldrin/elevator/controller"
 	"github.com/knutaldrin/elevator/driver"
+	"github.com/knutaldrin/elevator/journal"
 	"github.com/knutaldrin/elevator/log"
 	"github.com/knutaldrin/elevator/net"
+	"github.com/knutaldrin/elevator/net/udp"
 	"github.com/knutaldrin/elevator/queue"
+	"github.com/knutaldrin/elevator/store"
 )
 
 func main() {
 	id := flag.Uint("id", 1337, "Elevator ID")
+	floors := flag.Int("floors", driver.DefaultFloors, "Number of floors in the building")
+	backend := flag.String("driver", driver.DefaultBackend(), "Hardware backend: comedi (only when built with -tags comedi), sim or tcp")
+	addr := flag.String("addr", driver.DefaultServerAddr, "Elevator server address for the tcp backend")
+	dwell := flag.Duration("dwell", time.Second, "How long the door stays open")
+	doorMove := flag.Duration("doormove", 250*time.Millisecond, "How long the door takes to open or close")
+	stuckAfter := flag.Duration("stuck", 10*time.Second, "Obstructed door time before giving up hall orders")
+	iface := flag.String("iface", "", "Network interface to use, default is the one routing to the broadcast address")
+	bcast := flag.String("bcast", "", "Broadcast address, default is the interface's directed broadcast, or 255.255.255.255")
+	mcast := flag.String("mcast", "", "Multicast group (IPv4 or IPv6) to use instead of broadcast")
+	ttl := flag.Int("ttl", 1, "Multicast TTL")
+	mloop := flag.Bool("mloop", true, "Loop multicast back to this machine, for several elevators on one machine")
+	lport := flag.Int("lport", net.LPORT, "Local UDP port")
+	bport := flag.Int("bport", net.BPORT, "Broadcast UDP port")
+	group := flag.Uint("group", 0, "Elevator group, for several banks on one network")
+	assign := flag.String("assign", "cost", "Hall order assignment: cost (auction) or timer (first come). Same for every elevator in a group")
+	floorTime := flag.Duration("floortime", queue.DefaultFloorTime, "How long the car takes from one floor to the next, for estimating costs")
+	bidWindow := flag.Duration("bidwindow", 200*time.Millisecond, "How long cost assignment waits for bids")
+	dataDir := flag.String("datadir", store.DefaultDir(), "Where to keep state, to pick up where we left off after a restart")
+	fsync := flag.String("fsync", "always", "When the order journal is synced to disk: always, interval or never")
+	keyFile := flag.String("keyfile", "", "Network key file. Messages are signed and checked when given, SIGHUP reloads it")
+	flag.DurationVar(&net.MaxClockSkew, "clockskew", net.MaxClockSkew, "Largest clock difference between elevators allowed when authenticating")
+	flag.DurationVar(&net.PeerTimeout, "peertimeout", net.PeerTimeout, "Time without heartbeats before an elevator is considered lost")
+	log.Flags()
 	flag.Parse()
-
-	if *id > 9 {
-		log.Error("Elevator ID must be between 0 and 9")
+	if err := log.Start(); err != nil {
+		log.Error("Log file: ", err)
 		os.Exit(1)
 	}
+	log.HandleSignals()
 
-	log.Info("Id: ", *id)
-	queue.SetID(*id)
-
-	currentDirection := driver.DirectionDown
-	lastFloor := driver.Floor(0)
-
-	doorOpen := false
+	if *id > 0xffff {
+		log.Error("Elevator ID must be between 0 and 65535")
+		os.Exit(1)
+	}
 
-	// Init driver and make sure elevator is at a floor
-	driver.Init()
+	if *group > 0xffff {
+		log.Error("Group must be between 0 and 65535")
+		os.Exit(1)
+	}
 
-	queue.ImportInternalLog()
+	if *floors < 2 || *floors > 200 {
+		log.Error("Number of floors must be between 2 and 200")
+		os.Exit(1)
+	}
 
-	lastFloor = driver.Reset()
-	queue.Update(lastFloor)
-	queue.ClearOrderLocal(lastFloor, currentDirection)
+	log.Info("Id: ", *id)
 
-	floorCh := make(chan driver.Floor)
-	go driver.FloorListener(floorCh)
+	hw, err := driver.Open(*backend, *addr, driver.Floor(*floors))
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
 
-	floorBtnCh := make(chan driver.ButtonEvent, 8)
-	go driver.FloorButtonListener(floorBtnCh)
+	if *keyFile != "" {
+		if err := net.LoadKeys(*keyFile); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		go func() {
+			for range hupCh {
+				if err := net.LoadKeys(*keyFile); err != nil {
+					log.Error("Keeping the old keys: ", err)
+				}
+			}
+		}()
+	} else {
+		log.Info("No key file, anyone on the network can give orders")
+	}
 
-	orderReceiveCh := make(chan net.OrderMessage, 8)
-	go net.InitAndHandle(orderReceiveCh, *id)
+	syncPolicy, err := journal.ParseSyncPolicy(*fsync)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	state, err := store.Open(*dataDir, *id)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	journalFile := state.Path("journal")
+	orderLog, err := queue.OpenJournalLog(journalFile, journal.Options{Sync: syncPolicy})
+	if _, corrupt := err.(*store.CorruptError); corrupt {
+		// Better to forget our orders than to act on garbage. The others still know the hall orders.
+		log.Error(err)
+		store.Quarantine(journalFile)
+		orderLog, err = queue.OpenJournalLog(journalFile, journal.Options{Sync: syncPolicy})
+	}
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
 
-	timeoutCh := make(chan bool, 8)
-	queue.SetTimeoutCh(timeoutCh)
+	link := net.UDPLink(udp.Config{
+		Interface:     *iface,
+		Broadcast:     *bcast,
+		Multicast:     *mcast,
+		TTL:           *ttl,
+		Loopback:      *mloop,
+		LocalPort:     *lport,
+		BroadcastPort: *bport,
+	})
+	elev, err := controller.New(controller.Config{
+		ID:         *id,
+		NumFloors:  driver.Floor(*floors),
+		Group:      uint16(*group),
+		Dwell:      *dwell,
+		DoorMove:   *doorMove,
+		StuckAfter: *stuckAfter,
+		Assign:     *assign,
+		FloorTime:  *floorTime,
+		BidWindow:  *bidWindow,
+		OrderLog:   orderLog,
+		Store:      state,
+	}, hw, link)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	if sim, ok := hw.(*driver.Sim); ok {
+		log.Info("Running on simulated hardware, commands are read from stdin")
+		go sim.ReadCommands(os.Stdin)
+	}
 
 	// Oh, God almighty, please spare our ears
-	sigtermCh := make(chan os.Signal)
+	sigtermCh := make(chan os.Signal, 1)
 	signal.Notify(sigtermCh, os.Interrupt, syscall.SIGTERM)
 	go func(ch <-chan os.Signal) {
 		<-ch
-		driver.Stop()
+		elev.Halt()
+		if err := orderLog.Close(); err != nil {
+			log.Error("Order journal: ", err)
+		}
+		log.Info("Network delivery: ", elev.Endpoint().Stats())
+		if *keyFile != "" {
+			log.Info("Rejected by authentication: ", elev.Endpoint().Rejected())
+		}
+		log.Check(log.Close())
 		os.Exit(0)
 	}(sigtermCh)
 
-	// Ping timeout so we start in case we have logged orders from a previous crash
-	timeoutCh <- true
-
-	// Main event loop
-	for {
-		select {
-		// Elevator has arrived at a new floor
-		case fl := <-floorCh:
-			queue.Update(fl)
-			if queue.ShouldStop(fl) {
-				driver.Stop()
-				queue.ClearOrderLocal(fl, currentDirection)
-				log.Debug("Stopped at floor ", fl)
-				net.SendOrder(net.OrderMessage{Type: net.CompletedOrder, Floor: fl, Direction: currentDirection})
-
-				go func() {
-					doorOpen = true
-					driver.OpenDoor()
-					time.Sleep(1 * time.Second)
-					doorOpen = false
-					driver.CloseDoor()
-					timeoutCh <- true
-				}()
-			}
-
-		// A floor button was pressed
-		case btn := <-floorBtnCh:
-			queue.NewOrder(btn.Floor, btn.Dir)
-			if btn.Dir != driver.DirectionNone {
-				net.SendOrder(net.OrderMessage{Type: net.NewOrder, Floor: btn.Floor, Direction: btn.Dir})
-			}
-			if !doorOpen {
-				currentDirection = queue.NextDirection()
-				driver.Run(currentDirection)
-			}
-
-		// A message came in from the network
-		case o := <-orderReceiveCh:
-			switch o.Type {
-			case net.NewOrder:
-				log.Debug("New order, floor: ", o.Floor, ", dir: ", o.Direction)
-				queue.NewOrder(o.Floor, o.Direction)
-
-			case net.AcceptedOrder:
-				log.Debug("Remote accepted order, floor: ", o.Floor, ", dir: ", o.Direction)
-				queue.OrderAcceptedRemotely(o.Floor, o.Direction)
-
-			case net.CompletedOrder:
-				log.Debug("Remote completed order, floor: ", o.Floor, ", dir: ", o.Direction)
-				queue.ClearOrder(o.Floor, o.Direction)
-			}
-
-		// Something timed out. Wake if idle.
-		case <-timeoutCh:
-			currentDirection = queue.NextDirection()
-			if !doorOpen {
-				driver.Run(currentDirection)
-			}
-		}
-	}
+	elev.Run()
 }
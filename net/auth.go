@@ -0,0 +1,214 @@
+package net
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knutaldrin/elevator/log"
+)
+
+/** AUTHENTICATION
+ * Optional. With keys loaded, every message is signed with the sending key, and unsigned messages or
+ * messages that don't verify against one of our keys are rejected.
+ *
+ * TRAILER, after the payload, when flag bit 0 is set:
+ * 1 byte: key ID
+ * 8 bytes: timestamp, Unix nanoseconds
+ * 16 bytes: HMAC-SHA256 of everything before, truncated
+ *
+ * Replays are stopped by the timestamp, which must be within MaxClockSkew of our clock, and by
+ * remembering every sender, sequence number and timestamp seen for that long. Retransmissions are
+ * signed again with a new timestamp, so they still get through.
+ *
+ * KEY FILE, one key per line, # comments:
+ * <key ID 0-255> <key, hex, at least 16 bytes> [send]
+ *
+ * The key marked send is the one we sign with, the others are only accepted. To rotate without
+ * downtime: add the new key everywhere, mark it send everywhere, remove the old one. Send SIGHUP
+ * to reload the key file after each step.
+ */
+
+const (
+	flagAuth  byte = 1 << 0
+	macLen         = 16
+	authLen        = 1 + 8 + macLen
+	minKeyLen      = 16
+)
+
+// MaxClockSkew is how far off a message's timestamp may be from our clock
+var MaxClockSkew = 5 * time.Second
+
+// authError is why a message was rejected by authentication
+type authError string
+
+func (e authError) Error() string { return string(e) }
+
+// Keys are shared by every endpoint in the process
+var keyMutex = &sync.Mutex{}
+var keys map[byte][]byte // nil: authentication off
+var sendKey byte
+
+// stamp identifies a signed message, for replay protection
+type stamp struct {
+	sender uint
+	seq    uint32
+	time   uint64
+}
+
+// LoadKeys reads the key file and starts authenticating. On error, the keys we had are kept.
+func LoadKeys(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	newKeys := make(map[byte][]byte)
+	send := -1
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 3 || len(fields) < 2 || (len(fields) == 3 && fields[2] != "send") {
+			return fmt.Errorf("%s:%d: expected <id> <hex key> [send]", filename, line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 8)
+		if err != nil {
+			return fmt.Errorf("%s:%d: bad key ID: %v", filename, line, err)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return fmt.Errorf("%s:%d: bad key: %v", filename, line, err)
+		}
+		if len(key) < minKeyLen {
+			return fmt.Errorf("%s:%d: key must be at least %d bytes", filename, line, minKeyLen)
+		}
+		if _, dup := newKeys[byte(id)]; dup {
+			return fmt.Errorf("%s:%d: key %d is defined twice", filename, line, id)
+		}
+		newKeys[byte(id)] = key
+		if len(fields) == 3 {
+			if send >= 0 {
+				return fmt.Errorf("%s:%d: only one key can be marked send", filename, line)
+			}
+			send = int(id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if send < 0 {
+		return fmt.Errorf("%s: no key is marked send", filename)
+	}
+
+	keyMutex.Lock()
+	keys = newKeys
+	sendKey = byte(send)
+	keyMutex.Unlock()
+	log.Info("Loaded ", len(newKeys), " network keys, signing with key ", send)
+	return nil
+}
+
+// Rejected counts messages rejected by authentication
+func (e *Endpoint) Rejected() uint64 {
+	e.authMutex.Lock()
+	defer e.authMutex.Unlock()
+	return e.rejected
+}
+
+func mac(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)[:macLen]
+}
+
+// sign appends the trailer to a message without CRC, if we have keys
+func sign(buf []byte) []byte {
+	keyMutex.Lock()
+	defer keyMutex.Unlock()
+	if keys == nil {
+		return buf
+	}
+
+	buf[4] |= flagAuth
+	buf = append(buf, sendKey)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(time.Now().UnixNano()))
+	return append(buf, mac(keys[sendKey], buf)...)
+}
+
+// verify checks the trailer of a message without CRC, if we have keys
+func (e *Endpoint) verify(buf []byte) error {
+	keyMutex.Lock()
+	known := keys
+	keyMutex.Unlock()
+	if known == nil {
+		return nil
+	}
+	if buf[4]&flagAuth == 0 {
+		return authError("not signed")
+	}
+
+	trailer := buf[len(buf)-authLen:]
+	key, ok := known[trailer[0]]
+	if !ok {
+		return authError(fmt.Sprint("unknown key ", trailer[0]))
+	}
+	if !hmac.Equal(mac(key, buf[:len(buf)-macLen]), trailer[1+8:]) {
+		return authError("bad signature")
+	}
+
+	skew := time.Since(time.Unix(0, int64(binary.BigEndian.Uint64(trailer[1:]))))
+	if skew > MaxClockSkew || skew < -MaxClockSkew {
+		return authError(fmt.Sprint("timestamp off by ", skew))
+	}
+
+	id := stamp{
+		sender: uint(binary.BigEndian.Uint16(buf[7:])),
+		seq:    binary.BigEndian.Uint32(buf[14:]),
+		time:   binary.BigEndian.Uint64(trailer[1:]),
+	}
+	e.authMutex.Lock()
+	defer e.authMutex.Unlock()
+	if _, replayed := e.seenStamps[id]; replayed {
+		return authError("replayed")
+	}
+	e.seenStamps[id] = time.Now()
+	return nil
+}
+
+// forgetStamps forgets stamps too old to get past the clock check anyway
+func (e *Endpoint) forgetStamps() {
+	for {
+		time.Sleep(MaxClockSkew)
+
+		e.authMutex.Lock()
+		for id, when := range e.seenStamps {
+			if time.Since(when) > 2*MaxClockSkew {
+				delete(e.seenStamps, id)
+			}
+		}
+		e.authMutex.Unlock()
+	}
+}
+
+// reject counts and logs a message that failed authentication. Logging is rate limited, as it may be an attack.
+func (e *Endpoint) reject(err error, from string) {
+	e.authMutex.Lock()
+	defer e.authMutex.Unlock()
+	e.rejected++
+	if time.Since(e.lastRejectLog) > time.Second {
+		e.lastRejectLog = time.Now()
+		e.log.Warning("Rejected message from ", from, ": ", err, " (", e.rejected, " rejected so far)")
+	}
+}
@@ -0,0 +1,144 @@
+package net
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/knutaldrin/elevator/driver"
+)
+
+// withKeys loads a key file for the test, and turns authentication off again after
+func withKeys(t *testing.T, file string) {
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadKeys(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		keyMutex.Lock()
+		keys, sendKey = nil, 0
+		keyMutex.Unlock()
+	})
+}
+
+const testKeys = `# test keys
+1 000102030405060708090a0b0c0d0e0f
+2 101112131415161718191a1b1c1d1e1f send
+`
+
+func TestSignVerify(t *testing.T) {
+	withKeys(t, testKeys)
+	e := newTestEndpoint()
+	msg := OrderMessage{Type: AcceptedOrder, SenderID: 2, NumFloors: 4, Floor: 3, Direction: driver.DirectionDown, Seq: 42}
+
+	buf := encode(msg)
+	if buf[4]&flagAuth == 0 || len(buf) != headerLen+authLen+crcLen {
+		t.Fatalf("not signed: %x", buf)
+	}
+	if buf[headerLen] != 2 {
+		t.Fatalf("signed with key %d, expected 2", buf[headerLen])
+	}
+	got, err := e.decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Floor != 3 || got.Seq != 42 {
+		t.Fatalf("got %+v", got)
+	}
+
+	if _, err := e.decode(buf); err != authError("replayed") {
+		t.Fatalf("replay gave %v", err)
+	}
+
+	// Signed again, as retransmissions are
+	if _, err := e.decode(encode(msg)); err != nil {
+		t.Fatalf("retransmission gave %v", err)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	withKeys(t, testKeys)
+	e := newTestEndpoint()
+	msg := OrderMessage{Type: CompletedOrder, SenderID: 2, NumFloors: 4, Floor: 1, Direction: driver.DirectionUp}
+
+	tampered := encode(msg)
+	tampered[11] = 2 // Another floor
+	if _, err := e.decode(reseal(tampered)); err != authError("bad signature") {
+		t.Errorf("tampered gave %v", err)
+	}
+
+	unknown := encode(msg)
+	unknown[headerLen] = 9
+	if _, err := e.decode(reseal(unknown)); err != authError("unknown key 9") {
+		t.Errorf("unknown key gave %v", err)
+	}
+
+	keyMutex.Lock()
+	known := keys
+	keys = nil
+	keyMutex.Unlock()
+	unsigned := encode(msg)
+	keyMutex.Lock()
+	keys = known
+	keyMutex.Unlock()
+	if _, err := e.decode(unsigned); err != authError("not signed") {
+		t.Errorf("unsigned gave %v", err)
+	}
+
+	// Signed with a key of the same ID we don't have
+	withKeys(t, "2 202122232425262728292a2b2c2d2e2f send\n")
+	other := encode(msg)
+	withKeys(t, testKeys)
+	if _, err := e.decode(other); err != authError("bad signature") {
+		t.Errorf("wrong key gave %v", err)
+	}
+}
+
+func TestOthersIgnoredBeforeVerifying(t *testing.T) {
+	withKeys(t, testKeys)
+	e := newTestEndpoint()
+
+	// Another bank with keys of its own, and our own message coming back
+	other := encode(OrderMessage{Type: NewOrder, Group: 3, SenderID: 2, NumFloors: 4, Floor: 1})
+	other[headerLen] = 9
+	if _, err := e.decode(reseal(other)); err != errOtherGroup {
+		t.Errorf("another group gave %v", err)
+	}
+	own := encode(OrderMessage{Type: NewOrder, SenderID: 1, NumFloors: 4, Floor: 1})
+	if _, err := e.decode(own); err != errLoopback {
+		t.Errorf("our own gave %v", err)
+	}
+	if _, err := e.decode(own); err != errLoopback {
+		t.Errorf("our own again gave %v, expected no replay", err)
+	}
+}
+
+func TestLoadKeysRejects(t *testing.T) {
+	files := map[string]string{
+		"no send":   "1 000102030405060708090a0b0c0d0e0f\n",
+		"two sends": "1 000102030405060708090a0b0c0d0e0f send\n2 101112131415161718191a1b1c1d1e1f send\n",
+		"short key": "1 0001020304050607 send\n",
+		"not hex":   "1 zz0102030405060708090a0b0c0d0e0f send\n",
+		"duplicate": "1 000102030405060708090a0b0c0d0e0f send\n1 101112131415161718191a1b1c1d1e1f\n",
+		"bad ID":    "256 000102030405060708090a0b0c0d0e0f send\n",
+	}
+	dir := t.TempDir()
+	for name, file := range files {
+		path := filepath.Join(dir, "keys")
+		if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := LoadKeys(path); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+
+	keyMutex.Lock()
+	defer keyMutex.Unlock()
+	if keys != nil {
+		t.Error("keys loaded from bad files")
+	}
+}
@@ -0,0 +1,80 @@
+package net
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/knutaldrin/elevator/driver"
+)
+
+/** DESTINATION DISPATCH
+ * A keypad (see cmd/keypad) sends a DC when a passenger enters where they are going. Floor and direction
+ * are where they get on and which way, and the payload is the destination, 2 bytes. The call is known
+ * by the ID of the keypad and the sequence number of the DC.
+ *
+ * The elevators assign it like a hall order. AC, RL, CO and BD messages about it carry its ID at the
+ * end of the payload:
+ * 2 bytes: keypad ID
+ * 4 bytes: sequence number of the DC
+ *
+ * The AC is the answer to the keypad, the sender is the car to take.
+ */
+
+// CallID identifies a destination call
+type CallID struct {
+	Caller uint
+	Seq    uint32
+}
+
+const callLen = 6
+
+func encodeCallID(id CallID) []byte {
+	buf := binary.BigEndian.AppendUint16(nil, uint16(id.Caller))
+	return binary.BigEndian.AppendUint32(buf, id.Seq)
+}
+
+// decodeCall fills in Call, and Destination of a DC, and takes the call ID off the payload of messages about one
+func decodeCall(order *OrderMessage) error {
+	plain := 0
+	switch order.Type {
+	case DestinationCall:
+		if len(order.Payload) != 2 {
+			return fmt.Errorf("destination call payload is %d bytes", len(order.Payload))
+		}
+		order.Destination = driver.Floor(binary.BigEndian.Uint16(order.Payload))
+		if order.Destination < 0 || order.Destination >= order.NumFloors || order.Destination == order.Floor {
+			return fmt.Errorf("destination call from floor %d to %d", order.Floor, order.Destination)
+		}
+		order.Call = &CallID{Caller: order.SenderID, Seq: order.Seq}
+		return nil
+	case Bid:
+		plain = 4
+	case AcceptedOrder, CompletedOrder, ReleasedOrder:
+	default:
+		return nil
+	}
+
+	switch len(order.Payload) {
+	case plain:
+	case plain + callLen:
+		order.Call = &CallID{
+			Caller: uint(binary.BigEndian.Uint16(order.Payload[plain:])),
+			Seq:    binary.BigEndian.Uint32(order.Payload[plain+2:]),
+		}
+		order.Payload = order.Payload[:plain]
+	default:
+		return fmt.Errorf("%s payload is %d bytes", order.Type, len(order.Payload))
+	}
+	return nil
+}
+
+// SendCall sends a destination call, and gives what it will be known as
+func (e *Endpoint) SendCall(floor, dest driver.Floor) CallID {
+	dir := driver.DirectionUp
+	if dest < floor {
+		dir = driver.DirectionDown
+	}
+	e.log.With("floor", floor, "dest", dest).Info("Destination call")
+	seq := e.send(OrderMessage{Type: DestinationCall, Floor: floor, Direction: dir, Payload: binary.BigEndian.AppendUint16(nil, uint16(dest))})
+	return CallID{Caller: e.cfg.ID, Seq: seq}
+}
@@ -0,0 +1,45 @@
+package net
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/knutaldrin/elevator/driver"
+)
+
+func TestDecodeCall(t *testing.T) {
+	id := CallID{Caller: 60000, Seq: 0x01020304}
+
+	dc := OrderMessage{Type: DestinationCall, SenderID: id.Caller, Seq: id.Seq, NumFloors: 4, Floor: 1,
+		Direction: driver.DirectionUp, Payload: []byte{0, 3}}
+	if err := decodeCall(&dc); err != nil {
+		t.Fatal(err)
+	}
+	if dc.Destination != 3 || dc.Call == nil || *dc.Call != id {
+		t.Fatalf("DC to %d, call %v, expected to 3, call %v", dc.Destination, dc.Call, id)
+	}
+
+	bid := OrderMessage{Type: Bid, NumFloors: 4, Floor: 1, Payload: append([]byte{0, 0, 1, 0}, encodeCallID(id)...)}
+	if err := decodeCall(&bid); err != nil {
+		t.Fatal(err)
+	}
+	if bid.Call == nil || *bid.Call != id || !reflect.DeepEqual(bid.Payload, []byte{0, 0, 1, 0}) {
+		t.Fatalf("BD about %v with %v, expected %v with the cost", bid.Call, bid.Payload, id)
+	}
+
+	hall := OrderMessage{Type: AcceptedOrder, NumFloors: 4, Floor: 1}
+	if err := decodeCall(&hall); err != nil || hall.Call != nil {
+		t.Fatalf("AC for a hall order gave call %v, %v", hall.Call, err)
+	}
+
+	for _, payload := range [][]byte{{0, 4}, {0xff, 0xff}, {0, 1}, {0, 1, 2}} {
+		dc := OrderMessage{Type: DestinationCall, NumFloors: 4, Floor: 1, Payload: payload}
+		if err := decodeCall(&dc); err == nil {
+			t.Errorf("DC with payload %v to %d accepted", payload, dc.Destination)
+		}
+	}
+	short := OrderMessage{Type: CompletedOrder, NumFloors: 4, Payload: []byte{1, 2, 3}}
+	if err := decodeCall(&short); err == nil {
+		t.Error("CO with a short call ID accepted")
+	}
+}
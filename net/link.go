@@ -0,0 +1,72 @@
+package net
+
+import (
+	"sync"
+
+	"github.com/knutaldrin/elevator/net/udp"
+)
+
+// Link carries encoded messages between us and the others. Everything sent is heard by everyone on the link,
+// ourselves included.
+type Link struct {
+	Send    chan<- udp.Udp_message
+	Receive <-chan udp.Udp_message
+	// Errors and Connectivity are nil for links that never fail
+	Errors       <-chan error
+	Connectivity <-chan bool
+	Online       func() bool
+}
+
+// UDPLink broadcasts, or multicasts, on the real network
+func UDPLink(cfg udp.Config) Link {
+	sendCh := make(chan udp.Udp_message, 8)
+	recvCh := make(chan udp.Udp_message, 8)
+	cfg.MessageSize = MSGLEN
+	transport := udp.Udp_init(cfg, sendCh, recvCh)
+	return Link{
+		Send:         sendCh,
+		Receive:      recvCh,
+		Errors:       transport.Errors,
+		Connectivity: transport.Connectivity,
+		Online:       transport.Online,
+	}
+}
+
+// Hub is a network in a box, for several elevators in one process. Like the real thing, it drops
+// messages for anyone who doesn't keep up.
+type Hub struct {
+	mutex sync.Mutex
+	ports []chan udp.Udp_message
+}
+
+// NewHub makes an empty hub
+func NewHub() *Hub {
+	return &Hub{}
+}
+
+// Link joins the hub
+func (h *Hub) Link() Link {
+	sendCh := make(chan udp.Udp_message, 8)
+	recvCh := make(chan udp.Udp_message, 64)
+
+	h.mutex.Lock()
+	h.ports = append(h.ports, recvCh)
+	h.mutex.Unlock()
+
+	go func() {
+		for msg := range sendCh {
+			msg.Raddr = "hub"
+			msg.Length = len(msg.Data)
+
+			h.mutex.Lock()
+			for _, port := range h.ports {
+				select {
+				case port <- msg:
+				default:
+				}
+			}
+			h.mutex.Unlock()
+		}
+	}()
+	return Link{Send: sendCh, Receive: recvCh, Online: func() bool { return true }}
+}
@@ -0,0 +1,145 @@
+package net
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	crc16 "github.com/joaojeronimo/go-crc16"
+	"github.com/knutaldrin/elevator/driver"
+)
+
+/** MESSAGE FORMAT, version 2
+ * Binary, big endian. Offset, length:
+ *
+ *  0  2  magic, 0x454c ("EL")
+ *  2  1  version
+ *  3  1  type, see OrderType
+ *  4  1  flags, bit 0: authenticated, see auth.go. The rest are reserved, always 0
+ *  5  2  group, see Config
+ *  7  2  sender ID
+ *  9  2  number of floors in the sender's building
+ * 11  2  floor (0-indexed)
+ * 13  1  direction (0: up, 1: down, 2: none)
+ * 14  4  sequence number, counts up per sender from a random start
+ * 18  2  payload length, n
+ * 20  n  payload, depends on type
+ * 20+n a  authentication trailer, if flagged, see auth.go
+ * 20+n+a 2 CRC-16 of everything before. Not tamper-proof, but should be corruption-proof.
+ *
+ * Version 1 had no group.
+ */
+
+const (
+	magic         uint16 = 0x454c
+	version       byte   = 2
+	headerLen            = 20
+	crcLen               = 2
+	maxPayloadLen        = MSGLEN - headerLen - authLen - crcLen
+)
+
+// OrderType is an enum for communicating information about orders
+type OrderType uint8
+
+// Enum of order types
+const (
+	InvalidOrder    OrderType = iota
+	NewOrder                  // New order
+	AcceptedOrder             // Accepted order
+	CompletedOrder            // Completed order
+	ReleasedOrder             // Accepted by the sender, but handed back to the others
+	OutOfService              // Sender takes no hall orders, floor and direction unused
+	InService                 // In service again
+	Heartbeat                 // I'm alive. Floor and direction are the sender's, payload is a Status
+	Snapshot                  // All hall orders the sender knows of, payload is a list of HallOrder
+	Ack                       // Got your message. Payload is the ID and sequence number acknowledged
+	Bid                       // What the hall order in floor and direction would cost the sender, see SendBid
+	DestinationCall           // A passenger at floor going direction wants to go to the floor in the payload, see SendCall
+)
+
+func (t OrderType) String() string {
+	names := [...]string{"IV", "NW", "AC", "CO", "RL", "OS", "IS", "HB", "SS", "AK", "BD", "DC"}
+	if int(t) < len(names) {
+		return names[t]
+	}
+	return fmt.Sprintf("type %d", uint8(t))
+}
+
+// Not an elevator message, or one from a version we don't speak. Ignored quietly.
+var errNotOurs = errors.New("not an elevator message")
+
+// From an elevator bank we're not part of, or from ourselves looped back. Ignored before authentication, so
+// they don't count as rejected.
+var (
+	errOtherGroup = errors.New("message from another group")
+	errLoopback   = errors.New("message from ourselves")
+)
+
+func encode(order OrderMessage) []byte {
+	buf := make([]byte, headerLen, headerLen+len(order.Payload)+authLen+crcLen)
+	binary.BigEndian.PutUint16(buf[0:], magic)
+	buf[2] = version
+	buf[3] = byte(order.Type)
+	buf[4] = 0
+	binary.BigEndian.PutUint16(buf[5:], order.Group)
+	binary.BigEndian.PutUint16(buf[7:], uint16(order.SenderID))
+	binary.BigEndian.PutUint16(buf[9:], uint16(order.NumFloors))
+	binary.BigEndian.PutUint16(buf[11:], uint16(order.Floor))
+	buf[13] = byte(order.Direction)
+	binary.BigEndian.PutUint32(buf[14:], order.Seq)
+	binary.BigEndian.PutUint16(buf[18:], uint16(len(order.Payload)))
+	buf = append(buf, order.Payload...)
+	buf = sign(buf)
+
+	return binary.BigEndian.AppendUint16(buf, crc16.Crc16(buf))
+}
+
+func (e *Endpoint) decode(buf []byte) (OrderMessage, error) {
+	if len(buf) < 3 || binary.BigEndian.Uint16(buf) != magic || buf[2] != version {
+		return OrderMessage{}, errNotOurs
+	}
+	if len(buf) < headerLen+crcLen {
+		return OrderMessage{}, fmt.Errorf("message too short, %d bytes", len(buf))
+	}
+
+	payloadLen := int(binary.BigEndian.Uint16(buf[18:]))
+	end := headerLen + payloadLen
+	if buf[4]&flagAuth != 0 {
+		end += authLen
+	}
+	if len(buf) != end+crcLen {
+		return OrderMessage{}, fmt.Errorf("message is %d bytes, expected %d", len(buf), end+crcLen)
+	}
+	if crc16.Crc16(buf[:end]) != binary.BigEndian.Uint16(buf[end:]) {
+		return OrderMessage{}, errors.New("CRC mismatch") // Probably corrupted
+	}
+	if binary.BigEndian.Uint16(buf[5:]) != e.cfg.Group {
+		return OrderMessage{}, errOtherGroup
+	}
+	if uint(binary.BigEndian.Uint16(buf[7:])) == e.cfg.ID { // Don't loop
+		return OrderMessage{}, errLoopback
+	}
+	if err := e.verify(buf[:end]); err != nil {
+		return OrderMessage{}, err
+	}
+
+	order := OrderMessage{
+		Type:      OrderType(buf[3]),
+		Group:     binary.BigEndian.Uint16(buf[5:]),
+		SenderID:  uint(binary.BigEndian.Uint16(buf[7:])),
+		NumFloors: driver.Floor(binary.BigEndian.Uint16(buf[9:])),
+		Floor:     driver.Floor(binary.BigEndian.Uint16(buf[11:])),
+		Direction: driver.Direction(buf[13]),
+		Seq:       binary.BigEndian.Uint32(buf[14:]),
+	}
+	if payloadLen > 0 {
+		order.Payload = append([]byte(nil), buf[headerLen:headerLen+payloadLen]...)
+	}
+	if order.NumFloors < 2 {
+		return OrderMessage{}, fmt.Errorf("%s message for a building of %d floors", order.Type, order.NumFloors)
+	}
+	if order.Floor < 0 || order.Floor >= order.NumFloors || order.Direction > driver.DirectionNone {
+		return OrderMessage{}, fmt.Errorf("%s message for floor %d, dir %d is out of range", order.Type, order.Floor, order.Direction)
+	}
+	return order, nil
+}
@@ -0,0 +1,85 @@
+package net
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	crc16 "github.com/joaojeronimo/go-crc16"
+	"github.com/knutaldrin/elevator/driver"
+)
+
+func newTestEndpoint() *Endpoint {
+	return NewEndpoint(Config{ID: 1, NumFloors: 4}, Link{})
+}
+
+// reseal puts a correct CRC on a message that was messed with, so it gets past the CRC check
+func reseal(buf []byte) []byte {
+	end := len(buf) - crcLen
+	binary.BigEndian.PutUint16(buf[end:], crc16.Crc16(buf[:end]))
+	return buf
+}
+
+func TestEncodeDecode(t *testing.T) {
+	e := newTestEndpoint()
+	msgs := []OrderMessage{
+		{Type: NewOrder, Group: 3, SenderID: 2, NumFloors: 4, Floor: 2, Direction: driver.DirectionDown, Seq: 0xdeadbeef},
+		{Type: OutOfService, SenderID: 65535, NumFloors: 2, Floor: 1, Direction: driver.DirectionNone, Seq: 1},
+		{Type: CompletedOrder, SenderID: 5, NumFloors: 9, Floor: 8, Direction: driver.DirectionUp},
+		{Type: Snapshot, SenderID: 5, NumFloors: 9, Floor: 0, Direction: driver.DirectionUp,
+			Payload: encodeHallOrders([]HallOrder{{Floor: 8, Direction: driver.DirectionUp}})},
+	}
+	for _, msg := range msgs {
+		e.cfg.Group = msg.Group
+		got, err := e.decode(encode(msg))
+		if err != nil {
+			t.Errorf("decoding %s: %v", msg.Type, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, msg) {
+			t.Errorf("got %+v, expected %+v", got, msg)
+		}
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	e := newTestEndpoint()
+	good := OrderMessage{Type: NewOrder, SenderID: 2, NumFloors: 4, Floor: 1, Direction: driver.DirectionUp}
+
+	tests := []struct {
+		name string
+		mess func(buf []byte) []byte
+	}{
+		{"corrupted", func(buf []byte) []byte { buf[11]++; return buf }},
+		{"truncated", func(buf []byte) []byte { return reseal(buf[:len(buf)-1]) }},
+		{"negative floor", func(buf []byte) []byte { binary.BigEndian.PutUint16(buf[11:], 0xffff); return reseal(buf) }},
+		{"floor above", func(buf []byte) []byte { binary.BigEndian.PutUint16(buf[11:], 4); return reseal(buf) }},
+		{"one floor", func(buf []byte) []byte { binary.BigEndian.PutUint16(buf[9:], 1); buf[11] = 0; return reseal(buf) }},
+		{"direction", func(buf []byte) []byte { buf[13] = 3; return reseal(buf) }},
+	}
+	for _, tt := range tests {
+		if msg, err := e.decode(tt.mess(encode(good))); err == nil {
+			t.Errorf("%s: decoded %+v", tt.name, msg)
+		}
+	}
+
+	other := good
+	other.Group = 3
+	if _, err := e.decode(encode(other)); err != errOtherGroup {
+		t.Errorf("another group gave %v", err)
+	}
+	own := good
+	own.SenderID = 1
+	if _, err := e.decode(encode(own)); err != errLoopback {
+		t.Errorf("our own gave %v", err)
+	}
+
+	if _, err := e.decode([]byte("GET / HTTP/1.1")); err != errNotOurs {
+		t.Errorf("not ours gave %v", err)
+	}
+	buf := encode(good)
+	buf[2] = version + 1
+	if _, err := e.decode(reseal(buf)); err != errNotOurs {
+		t.Errorf("another version gave %v", err)
+	}
+}
@@ -1,116 +1,224 @@
 package net
 
 import (
-	"strconv"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	crc16 "github.com/joaojeronimo/go-crc16"
 	"github.com/knutaldrin/elevator/driver"
 	"github.com/knutaldrin/elevator/log"
 	"github.com/knutaldrin/elevator/net/udp"
 )
 
-/** NEW MESSAGE FORMAT
- * Always 8 chars
- *
- * 2 chars: type
- * * NW = New order
- * * AC = Accepted order
- * * CO = Completed order
- * 1 char: Always 0, reserved for future
- * 1 char: ID
- * 1 char: floor (0-indexed)
- * 1 char: direction (0: up, 1: down)
- * 2 chars: CRC-16 of the previous 6 bytes
- */
-
-//OrderType is an enum for communicating information about orders
-type OrderType string
-
-// Enum of order types
-const (
-	InvalidOrder   OrderType = "IV"
-	NewOrder       OrderType = "NW"
-	AcceptedOrder  OrderType = "AC"
-	CompletedOrder OrderType = "CO"
-)
-
 // OrderMessage struct of a net message
 type OrderMessage struct {
 	Type      OrderType
+	Group     uint16
 	SenderID  uint
+	NumFloors driver.Floor
 	Floor     driver.Floor
 	Direction driver.Direction
+	Seq       uint32
+	Payload   []byte
+	Orders    []HallOrder // Decoded payload of a Snapshot
+	Cost      uint32      // Decoded payload of a Bid
+	// Call is the destination call a DC, AC, CO, RL or BD is about, nil for hall orders
+	Call        *CallID
+	Destination driver.Floor // Decoded payload of a DestinationCall
 }
 
-func orderToStr(order OrderMessage) string {
-	str := string(order.Type) + "0" + strconv.Itoa(int(order.SenderID)) + strconv.Itoa(int(order.Floor)) + strconv.Itoa(int(order.Direction))
-	crc := crc16.Crc16([]byte(str))
-	// HAXHAX bitshift and convert to byte slice -> string
-	str += string([]byte{byte((crc >> 8) & 0xff), byte(crc & 0xff)})
-	return str
-}
+// LPORT Default local listen port
+const LPORT = 13376
 
-func strToOrder(str string) OrderMessage {
-	// Check for CRC mismatch. Not tamper-proof, but should be corruption-proof.
-	calculatedCrc := crc16.Crc16([]byte(str[:6]))
-	receivedCrc := (uint16(str[6]) << 8) + uint16(str[7])
+// BPORT Default broadcast listen port
+const BPORT = 13377
 
-	if calculatedCrc != receivedCrc {
-		log.Error("CRC mismatch in " + str[:4] + " message!")
-		return OrderMessage{Type: InvalidOrder} // Probably corrupted
-	}
+// MSGLEN Longest network message we can receive
+const MSGLEN = 1024
+
+// Config is who we are on the network
+type Config struct {
+	ID        uint
+	NumFloors driver.Floor
+	// Group keeps elevator banks sharing a network apart. Messages from other groups are ignored.
+	Group uint16
+	// Keypad joins as a destination keypad instead of an elevator. It never takes orders.
+	Keypad bool
+}
 
-	senderID, _ := strconv.Atoi(string(str[3]))
-	floorNum, _ := strconv.Atoi(string(str[4]))
-	dirNum, _ := strconv.Atoi(string(str[5]))
+// Endpoint is one elevator, or keypad, on a link. Several can share a process.
+type Endpoint struct {
+	cfg  Config
+	link Link
 
-	return OrderMessage{Type: OrderType(str[:2]), SenderID: uint(senderID), Floor: driver.Floor(floorNum), Direction: driver.Direction(dirNum)}
+	// Sequence number of the last message we sent. Random start, so a quick restart doesn't look like duplicates.
+	lastSeq uint32
 
-}
+	// Peers with another number of floors than us, so we only complain once
+	mismatched map[uint]bool
 
-var udpSendCh, udpRecvCh chan udp.Udp_message
+	peerMutex   sync.Mutex
+	peers       map[uint]*Peer
+	localStatus Status
 
-// LPORT Local listen port
-const LPORT = 13376
+	reliableMutex sync.Mutex
+	stats         DeliveryStats
+	unacked       map[uint32]*outstanding       // by our sequence number
+	seenSeqs      map[uint]map[uint32]time.Time // by sender, then their sequence number
 
-// BPORT Broadcast listen port
-const BPORT = 13377
+	authMutex     sync.Mutex
+	rejected      uint64
+	lastRejectLog time.Time
+	seenStamps    map[stamp]time.Time // When we saw it
 
-// MSGLEN Network message length
-const MSGLEN = 8
+	log *log.Logger
+}
 
-var elevatorID uint
+// NewEndpoint puts us on the link. Call Handle to start talking.
+func NewEndpoint(cfg Config, link Link) *Endpoint {
+	idKey := "elevator"
+	if cfg.Keypad {
+		idKey = "keypad"
+	}
+	return &Endpoint{
+		cfg:         cfg,
+		link:        link,
+		lastSeq:     rand.Uint32(),
+		mismatched:  make(map[uint]bool),
+		peers:       make(map[uint]*Peer),
+		localStatus: Status{InService: true},
+		unacked:     make(map[uint32]*outstanding),
+		seenSeqs:    make(map[uint]map[uint32]time.Time),
+		seenStamps:  make(map[stamp]time.Time),
+		log:         log.With(idKey, cfg.ID),
+	}
+}
+
+// ID we are known by
+func (e *Endpoint) ID() uint {
+	return e.cfg.ID
+}
 
 // SendOrder sends the parameter order struct to the network
-func SendOrder(order OrderMessage) {
-	if order.Direction == driver.DirectionNone {
-		log.Warning("Transmitted order cannot have no direction")
+func (e *Endpoint) SendOrder(order OrderMessage) {
+	isStatus := order.Type == OutOfService || order.Type == InService
+	if order.Direction == driver.DirectionNone && !isStatus {
+		e.log.Warning("Transmitted order cannot have no direction")
 		return
 	}
-	order.SenderID = elevatorID
-	str := orderToStr(order)
-	log.Debug("Sending message: ", str)
-	udpSendCh <- udp.Udp_message{Raddr: "broadcast", Data: str}
+	e.send(order)
 }
 
-// InitAndHandle initializes network and handles receive
-func InitAndHandle(receiveCh chan<- OrderMessage, id uint) {
-	udpSendCh = make(chan udp.Udp_message, 8)
-	udpRecvCh = make(chan udp.Udp_message, 8)
+// send stamps a message with who we are and broadcasts it. Gives its sequence number.
+func (e *Endpoint) send(order OrderMessage) uint32 {
+	order.Group = e.cfg.Group
+	order.SenderID = e.cfg.ID
+	order.NumFloors = e.cfg.NumFloors
+	order.Seq = atomic.AddUint32(&e.lastSeq, 1)
+	if log.Enabled(log.LevelTrace) {
+		e.logMessage(order).Bullshit("Sending message")
+	}
+	if order.Call != nil && order.Type != DestinationCall {
+		order.Payload = append(append([]byte(nil), order.Payload...), encodeCallID(*order.Call)...)
+	}
+	if reliable(order.Type) {
+		e.expectAcks(order)
+	}
+	e.link.Send <- udp.Udp_message{Raddr: "broadcast", Data: string(encode(order))}
+	return order.Seq
+}
 
-	elevatorID = id
+// logMessage gives a logger with the fields of a message
+func (e *Endpoint) logMessage(order OrderMessage) *log.Logger {
+	return e.log.With("type", order.Type, "from", order.SenderID, "seq", order.Seq, "floor", order.Floor, "dir", order.Direction)
+}
 
-	udp.Udp_init(LPORT, BPORT, MSGLEN, udpSendCh, udpRecvCh)
+// Online is true while we can talk to the network
+func (e *Endpoint) Online() bool {
+	return e.link.Online()
+}
+
+// Handle handles receive, forever. Elevators joining and leaving are reported on peerCh,
+// and losing or regaining the network on onlineCh.
+func (e *Endpoint) Handle(receiveCh chan<- OrderMessage, peerCh chan<- PeerUpdate, onlineCh chan<- bool) {
+	if e.link.Errors != nil {
+		go func() {
+			for err := range e.link.Errors {
+				e.log.Warning("Network: ", err)
+			}
+		}()
+	}
+	if e.link.Connectivity != nil {
+		go func() {
+			for online := range e.link.Connectivity {
+				if online {
+					e.log.Info("Network is up")
+				} else {
+					e.log.Warning("Network is down")
+				}
+				onlineCh <- online
+			}
+		}()
+	}
+
+	go e.heartbeat()
+	go e.reapPeers(peerCh)
+	go e.retransmit()
+	go e.forgetStamps()
 
 	for {
-		msg := <-udpRecvCh
-		if msg.Length != 8 { // Disregard messages not 8 in length
-			log.Warning("Non-8-byte message received")
+		msg := <-e.link.Receive
+		order, err := e.decode([]byte(msg.Data[:msg.Length]))
+		if err != nil {
+			if _, ok := err.(authError); ok {
+				e.reject(err, msg.Raddr)
+			} else if err == errOtherGroup {
+				e.log.With("from", msg.Raddr).Bullshit("Message from another group ignored")
+			} else if err != errNotOurs && err != errLoopback {
+				e.log.Warning("Bad message from ", msg.Raddr, ": ", err)
+			}
 			continue
 		}
-		order := strToOrder(msg.Data)
-		if order.SenderID != elevatorID { // Don't loop
-			log.Info("Received order: ID: ", order.SenderID, ", type: ", order.Type, ", floor: ", order.Floor)
+		if order.NumFloors != e.cfg.NumFloors {
+			// Their floors aren't our floors, so their orders would be nonsense to us
+			if !e.mismatched[order.SenderID] {
+				e.log.Error("Elevator ", order.SenderID, " has ", order.NumFloors, " floors, we have ", e.cfg.NumFloors, ". Ignoring it")
+				e.mismatched[order.SenderID] = true
+			}
+			continue
+		}
+		e.seen(order, peerCh)
+		if order.Type == Ack {
+			e.acked(order)
+			continue
+		}
+		if reliable(order.Type) {
+			e.sendAck(order)
+			if e.duplicate(order) {
+				continue
+			}
+		}
+		if order.Type == Snapshot {
+			if order.Orders, err = decodeHallOrders(order.Payload, order.NumFloors); err != nil {
+				e.log.Warning("Bad snapshot from elevator ", order.SenderID, ": ", err)
+				continue
+			}
+		}
+		if err := decodeCall(&order); err != nil {
+			e.log.Warning("Bad message from elevator ", order.SenderID, ": ", err)
+			continue
+		}
+		if order.Type == Bid {
+			if len(order.Payload) != 4 {
+				e.log.Warning("Bad bid from elevator ", order.SenderID)
+				continue
+			}
+			order.Cost = binary.BigEndian.Uint32(order.Payload)
+		}
+		if order.Type != Heartbeat {
+			e.logMessage(order).Info("Received order")
 			receiveCh <- order
 		}
 	}
@@ -0,0 +1,169 @@
+package net
+
+import (
+	"sort"
+	"time"
+
+	"github.com/knutaldrin/elevator/driver"
+)
+
+// HeartbeatInterval is how often we tell the others we're alive
+var HeartbeatInterval = 100 * time.Millisecond
+
+// PeerTimeout is how long an elevator may be silent before it is considered lost
+var PeerTimeout = time.Second
+
+// SyncDelay is how long an elevator may disagree with us about the hall orders before we send it ours.
+// Orders take a moment to spread, so don't shout at every heartbeat.
+var SyncDelay = time.Second
+
+// Status is what an elevator tells the others in its heartbeat
+type Status struct {
+	Floor     driver.Floor
+	Direction driver.Direction
+	DoorOpen  bool
+	InService bool
+	Orders    uint16 // Digest of the hall orders the elevator knows of
+	Keypad    bool   // Not an elevator, but a destination keypad. Never in service.
+}
+
+// Peer is another elevator, as we last heard from it
+type Peer struct {
+	ID uint
+	Status
+	LastSeen time.Time
+
+	divergedSince, lastSync time.Time
+}
+
+// PeerUpdate is sent when an elevator joins or is lost, or disagrees with us about the hall orders.
+// Joined and diverged elevators should be sent a Snapshot.
+type PeerUpdate struct {
+	Peer
+	Lost     bool
+	Diverged bool
+}
+
+// SetStatus updates what we send in our heartbeat
+func (e *Endpoint) SetStatus(s Status) {
+	e.peerMutex.Lock()
+	e.localStatus = s
+	e.peerMutex.Unlock()
+}
+
+// Peers gives the elevators we currently hear from, sorted by ID
+func (e *Endpoint) Peers() []Peer {
+	e.peerMutex.Lock()
+	defer e.peerMutex.Unlock()
+
+	list := make([]Peer, 0, len(e.peers))
+	for _, p := range e.peers {
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+/** HEARTBEAT PAYLOAD
+ * 1 byte: door open (0/1)
+ * 1 byte: in service (0/1)
+ * 2 bytes: hall order digest, see Digest
+ * 1 byte: flags, bit 0: keypad. Missing from older versions.
+ * Floor and direction go in the header.
+ */
+
+func b2byte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (e *Endpoint) heartbeat() {
+	for {
+		e.peerMutex.Lock()
+		s := e.localStatus
+		e.peerMutex.Unlock()
+
+		e.send(OrderMessage{
+			Type:      Heartbeat,
+			Floor:     s.Floor,
+			Direction: s.Direction,
+			Payload:   []byte{b2byte(s.DoorOpen), b2byte(s.InService), byte(s.Orders >> 8), byte(s.Orders), b2byte(e.cfg.Keypad)},
+		})
+		time.Sleep(HeartbeatInterval)
+	}
+}
+
+// seen is called for every message from another elevator
+func (e *Endpoint) seen(order OrderMessage, peerCh chan<- PeerUpdate) {
+	e.peerMutex.Lock()
+	p, known := e.peers[order.SenderID]
+	if !known {
+		p = &Peer{ID: order.SenderID, Status: Status{InService: true}}
+		e.peers[order.SenderID] = p
+	}
+	now := time.Now()
+	p.LastSeen = now
+	diverged := false
+
+	switch order.Type {
+	case Heartbeat:
+		p.Floor = order.Floor
+		p.Direction = order.Direction
+		if len(order.Payload) >= 4 {
+			p.DoorOpen = order.Payload[0] != 0
+			p.InService = order.Payload[1] != 0
+			p.Orders = uint16(order.Payload[2])<<8 | uint16(order.Payload[3])
+		}
+		if len(order.Payload) >= 5 && order.Payload[4]&1 != 0 {
+			// Keypads know no hall orders, and take none
+			p.Keypad, p.InService = true, false
+		}
+
+		if p.Keypad || e.cfg.Keypad || p.Orders == e.localStatus.Orders {
+			p.divergedSince = time.Time{}
+		} else if p.divergedSince.IsZero() {
+			p.divergedSince = now
+		} else if now.Sub(p.divergedSince) > SyncDelay && now.Sub(p.lastSync) > SyncDelay {
+			p.lastSync = now
+			diverged = true
+		}
+	case OutOfService:
+		p.InService = false
+	case InService:
+		p.InService = !p.Keypad
+	}
+	update := PeerUpdate{Peer: *p}
+	e.peerMutex.Unlock()
+
+	if !known {
+		e.log.Info("Elevator ", update.ID, " joined")
+		peerCh <- update
+	} else if diverged {
+		e.log.Info("Elevator ", update.ID, " disagrees about the hall orders")
+		peerCh <- PeerUpdate{Peer: update.Peer, Diverged: true}
+	}
+}
+
+// reapPeers forgets elevators we haven't heard from in PeerTimeout
+func (e *Endpoint) reapPeers(peerCh chan<- PeerUpdate) {
+	for {
+		time.Sleep(HeartbeatInterval)
+
+		var lost []PeerUpdate
+		e.peerMutex.Lock()
+		for id, p := range e.peers {
+			if time.Since(p.LastSeen) > PeerTimeout {
+				lost = append(lost, PeerUpdate{Peer: *p, Lost: true})
+				delete(e.peers, id)
+			}
+		}
+		e.peerMutex.Unlock()
+
+		for _, update := range lost {
+			e.log.Warning("Lost elevator ", update.ID)
+			peerCh <- update
+		}
+	}
+}
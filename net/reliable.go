@@ -0,0 +1,180 @@
+package net
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/knutaldrin/elevator/driver"
+	"github.com/knutaldrin/elevator/net/udp"
+)
+
+/** RELIABLE DELIVERY
+ * Everything but heartbeats and acks is acknowledged by every peer that was alive when it was sent.
+ * Unacknowledged messages are retransmitted, with the same sequence number but signed again if we
+ * authenticate, with exponential backoff until all of those peers have acked it or are lost. Receivers ack every copy, but only act on the first.
+ *
+ * ACK PAYLOAD
+ * 2 bytes: ID of the sender of the acknowledged message
+ * 4 bytes: its sequence number
+ */
+
+// RetransmitMin is the wait before the first retransmission. It doubles for every attempt, up to RetransmitMax.
+var RetransmitMin = 50 * time.Millisecond
+
+// RetransmitMax is the longest wait between retransmissions
+var RetransmitMax = time.Second
+
+// How long we remember sequence numbers we have seen, far longer than anyone retransmits for
+const duplicateMemory = 30 * time.Second
+
+// DeliveryStats counts what reliable delivery has been up to
+type DeliveryStats struct {
+	Sent          uint64 // Reliable messages sent
+	Retransmitted uint64 // Copies sent again
+	Delivered     uint64 // Messages acked by every peer
+	Abandoned     uint64 // Messages whose remaining peers were all lost before acking
+	Received      uint64 // Reliable messages received
+	Duplicates    uint64 // Copies received of messages we already had
+}
+
+func (s DeliveryStats) String() string {
+	return fmt.Sprintf("sent %d, retransmitted %d, delivered %d, abandoned %d, received %d, duplicates %d",
+		s.Sent, s.Retransmitted, s.Delivered, s.Abandoned, s.Received, s.Duplicates)
+}
+
+type outstanding struct {
+	order    OrderMessage
+	waiting  map[uint]bool // peers yet to ack
+	attempts uint
+	next     time.Time
+}
+
+// Stats gives the reliable delivery counters
+func (e *Endpoint) Stats() DeliveryStats {
+	e.reliableMutex.Lock()
+	defer e.reliableMutex.Unlock()
+	return e.stats
+}
+
+func reliable(t OrderType) bool {
+	return t != Heartbeat && t != Ack
+}
+
+// expectAcks starts waiting for acks from everyone alive
+func (e *Endpoint) expectAcks(order OrderMessage) {
+	waiting := make(map[uint]bool)
+	for _, p := range e.Peers() {
+		waiting[p.ID] = true
+	}
+
+	e.reliableMutex.Lock()
+	defer e.reliableMutex.Unlock()
+	e.stats.Sent++
+	if len(waiting) == 0 {
+		// Nobody to tell
+		e.stats.Delivered++
+		return
+	}
+	e.unacked[order.Seq] = &outstanding{order: order, waiting: waiting, next: time.Now().Add(RetransmitMin)}
+}
+
+func (e *Endpoint) sendAck(order OrderMessage) {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(order.SenderID))
+	payload = binary.BigEndian.AppendUint32(payload, order.Seq)
+	e.send(OrderMessage{Type: Ack, Direction: driver.DirectionNone, Payload: payload})
+}
+
+// acked is called for every ack, most of them for someone else
+func (e *Endpoint) acked(ack OrderMessage) {
+	if len(ack.Payload) != 6 || uint(binary.BigEndian.Uint16(ack.Payload)) != e.cfg.ID {
+		return
+	}
+	seq := binary.BigEndian.Uint32(ack.Payload[2:])
+
+	e.reliableMutex.Lock()
+	defer e.reliableMutex.Unlock()
+	if o, ok := e.unacked[seq]; ok {
+		delete(o.waiting, ack.SenderID)
+		if len(o.waiting) == 0 {
+			e.stats.Delivered++
+			delete(e.unacked, seq)
+		}
+	}
+}
+
+// duplicate is true if we have seen the message before
+func (e *Endpoint) duplicate(order OrderMessage) bool {
+	e.reliableMutex.Lock()
+	defer e.reliableMutex.Unlock()
+
+	seqs, ok := e.seenSeqs[order.SenderID]
+	if !ok {
+		seqs = make(map[uint32]time.Time)
+		e.seenSeqs[order.SenderID] = seqs
+	}
+	if _, dup := seqs[order.Seq]; dup {
+		e.stats.Duplicates++
+		e.logMessage(order).Bullshit("Duplicate")
+		return true
+	}
+	e.stats.Received++
+	seqs[order.Seq] = time.Now()
+	return false
+}
+
+// retransmit sends again whatever hasn't been acked in time, and forgets old sequence numbers
+func (e *Endpoint) retransmit() {
+	for {
+		time.Sleep(RetransmitMin / 2)
+
+		alive := make(map[uint]bool)
+		for _, p := range e.Peers() {
+			alive[p.ID] = true
+		}
+		now := time.Now()
+
+		var resend []OrderMessage
+		e.reliableMutex.Lock()
+		for seq, o := range e.unacked {
+			for id := range o.waiting {
+				if !alive[id] {
+					delete(o.waiting, id)
+				}
+			}
+			if len(o.waiting) == 0 {
+				e.stats.Abandoned++
+				delete(e.unacked, seq)
+				continue
+			}
+			if now.Before(o.next) {
+				continue
+			}
+
+			o.attempts++
+			backoff := RetransmitMin << o.attempts
+			if backoff > RetransmitMax || backoff <= 0 {
+				backoff = RetransmitMax
+			}
+			o.next = now.Add(backoff)
+			e.stats.Retransmitted++
+			resend = append(resend, o.order)
+		}
+
+		for id, seqs := range e.seenSeqs {
+			for seq, t := range seqs {
+				if now.Sub(t) > duplicateMemory {
+					delete(seqs, seq)
+				}
+			}
+			if len(seqs) == 0 {
+				delete(e.seenSeqs, id)
+			}
+		}
+		e.reliableMutex.Unlock()
+
+		for _, order := range resend {
+			e.link.Send <- udp.Udp_message{Raddr: "broadcast", Data: string(encode(order))}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package net
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	crc16 "github.com/joaojeronimo/go-crc16"
+	"github.com/knutaldrin/elevator/driver"
+	"github.com/knutaldrin/elevator/log"
+)
+
+// HallOrder is a hall order as one elevator knows it
+type HallOrder struct {
+	Floor     driver.Floor
+	Direction driver.Direction
+	Accepted  bool
+	Owner     uint // Only meaningful if Accepted
+}
+
+/** SNAPSHOT PAYLOAD
+ * 2 bytes: number of orders, then for each order:
+ * 2 bytes: floor
+ * 1 byte: direction
+ * 1 byte: accepted (0/1)
+ * 2 bytes: owner ID
+ */
+
+const hallOrderLen = 6
+
+func encodeHallOrders(orders []HallOrder) []byte {
+	if max := (maxPayloadLen - 2) / hallOrderLen; len(orders) > max {
+		log.Warning("Too many hall orders for one snapshot, sending the first ", max)
+		orders = orders[:max]
+	}
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(orders)))
+	for _, o := range orders {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(o.Floor))
+		buf = append(buf, byte(o.Direction), b2byte(o.Accepted))
+		buf = binary.BigEndian.AppendUint16(buf, uint16(o.Owner))
+	}
+	return buf
+}
+
+func decodeHallOrders(buf []byte, numFloors driver.Floor) ([]HallOrder, error) {
+	if len(buf) < 2 {
+		return nil, fmt.Errorf("payload too short")
+	}
+	n := int(binary.BigEndian.Uint16(buf))
+	if len(buf) != 2+n*hallOrderLen {
+		return nil, fmt.Errorf("payload is %d bytes, expected %d for %d orders", len(buf), 2+n*hallOrderLen, n)
+	}
+
+	orders := make([]HallOrder, n)
+	for i := range orders {
+		b := buf[2+i*hallOrderLen:]
+		orders[i] = HallOrder{
+			Floor:     driver.Floor(binary.BigEndian.Uint16(b)),
+			Direction: driver.Direction(b[2]),
+			Accepted:  b[3] != 0,
+			Owner:     uint(binary.BigEndian.Uint16(b[4:])),
+		}
+		if orders[i].Floor < 0 || orders[i].Floor >= numFloors || orders[i].Direction >= driver.DirectionNone {
+			return nil, fmt.Errorf("order for floor %d, dir %d is out of range", orders[i].Floor, orders[i].Direction)
+		}
+	}
+	return orders, nil
+}
+
+// Digest of which hall orders exist, for cheaply comparing views in heartbeats.
+// Who has accepted what is left out, it is allowed to differ for a moment.
+func Digest(orders []HallOrder) uint16 {
+	keys := make([]int, len(orders))
+	for i, o := range orders {
+		keys[i] = int(o.Floor)*2 + int(o.Direction)
+	}
+	sort.Ints(keys)
+
+	buf := make([]byte, 0, 2*len(keys))
+	for _, k := range keys {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(k))
+	}
+	return crc16.Crc16(buf)
+}
+
+// BidMessage tells the others what serving a hall order or destination call would cost us. The payload is the
+// cost, 4 bytes.
+func BidMessage(floor driver.Floor, dir driver.Direction, call *CallID, cost uint32) OrderMessage {
+	return OrderMessage{Type: Bid, Floor: floor, Direction: dir, Call: call, Payload: binary.BigEndian.AppendUint32(nil, cost)}
+}
+
+// SendSnapshot tells the others about all hall orders we know of
+func (e *Endpoint) SendSnapshot(orders []HallOrder) {
+	e.log.Debug("Sending snapshot of ", len(orders), " hall orders")
+	e.send(OrderMessage{Type: Snapshot, Direction: driver.DirectionNone, Payload: encodeHallOrders(orders)})
+}
@@ -0,0 +1,42 @@
+package net
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/knutaldrin/elevator/driver"
+)
+
+func TestHallOrders(t *testing.T) {
+	orders := []HallOrder{
+		{Floor: 0, Direction: driver.DirectionUp},
+		{Floor: 2, Direction: driver.DirectionDown, Accepted: true, Owner: 7},
+		{Floor: 3, Direction: driver.DirectionDown, Accepted: true, Owner: 65535},
+	}
+	got, err := decodeHallOrders(encodeHallOrders(orders), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, orders) {
+		t.Fatalf("got %+v, expected %+v", got, orders)
+	}
+
+	if got, err := decodeHallOrders(encodeHallOrders(nil), 4); err != nil || len(got) != 0 {
+		t.Fatalf("no orders gave %v, %v", got, err)
+	}
+
+	bad := []HallOrder{
+		{Floor: -1, Direction: driver.DirectionDown},
+		{Floor: 4, Direction: driver.DirectionUp},
+		{Floor: 1, Direction: driver.DirectionNone},
+	}
+	for _, o := range bad {
+		if got, err := decodeHallOrders(encodeHallOrders([]HallOrder{o}), 4); err == nil {
+			t.Errorf("%+v decoded as %+v", o, got)
+		}
+	}
+	buf := encodeHallOrders(orders)
+	if _, err := decodeHallOrders(buf[:len(buf)-1], 4); err == nil {
+		t.Error("truncated snapshot decoded")
+	}
+}
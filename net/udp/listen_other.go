@@ -0,0 +1,14 @@
+//go:build !unix
+
+package udp
+
+import "net"
+
+func listen(network string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	return net.ListenUDP(network, addr)
+}
+
+// setMulticastOptions is not supported here, so multicast gets the OS defaults
+func setMulticastOptions(conn *net.UDPConn, ipv6 bool, ifi *net.Interface, ttl int, loop bool) error {
+	return nil
+}
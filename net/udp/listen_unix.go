@@ -0,0 +1,75 @@
+//go:build unix
+
+package udp
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// listen with SO_REUSEADDR, so several elevators on one machine can share the broadcast port
+func listen(network string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}}
+	conn, err := lc.ListenPacket(context.Background(), network, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// setMulticastOptions sets the TTL, loopback and outgoing interface for multicast sent on conn
+func setMulticastOptions(conn *net.UDPConn, ipv6 bool, ifi *net.Interface, ttl int, loop bool) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	loopInt := 0
+	if loop {
+		loopInt = 1
+	}
+
+	cerr := rc.Control(func(fd uintptr) {
+		s := int(fd)
+		if ipv6 {
+			if err = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, ttl); err != nil {
+				return
+			}
+			if err = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_LOOP, loopInt); err != nil {
+				return
+			}
+			if ifi != nil {
+				err = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, ifi.Index)
+			}
+			return
+		}
+
+		if err = syscall.SetsockoptByte(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, byte(ttl)); err != nil {
+			return
+		}
+		if err = syscall.SetsockoptByte(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, byte(loopInt)); err != nil {
+			return
+		}
+		if ifi != nil {
+			var ip net.IP
+			if ip, err = interfaceIPv4(ifi); err == nil {
+				var addr [4]byte
+				copy(addr[:], ip)
+				err = syscall.SetsockoptInet4Addr(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, addr)
+			}
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package udp
+
+import (
+	"fmt"
+	"net"
+)
+
+// interfaceIPv4 gives the first IPv4 address of an interface
+func interfaceIPv4(ifi *net.Interface) (net.IP, error) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.To4(), nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no IPv4 address", ifi.Name)
+}
+
+// openMulticast joins the multicast group instead of listening for broadcasts.
+// We send from a wildcard address, the group is reached through the interface if given, else the default route.
+func (t *Transport) openMulticast() (*sockets, error) {
+	ip := net.ParseIP(t.cfg.Multicast)
+	if ip == nil || !ip.IsMulticast() {
+		return nil, fmt.Errorf("%q is not a multicast address", t.cfg.Multicast)
+	}
+	ipv6 := ip.To4() == nil
+	network := "udp4"
+	if ipv6 {
+		network = "udp6"
+	}
+
+	var ifi *net.Interface
+	if t.cfg.Interface != "" {
+		var err error
+		if ifi, err = interfaceByName(t.cfg.Interface); err != nil {
+			return nil, err
+		}
+	}
+
+	gaddr := &net.UDPAddr{IP: ip, Port: t.cfg.BroadcastPort}
+	laddr := &net.UDPAddr{Port: t.cfg.LocalPort}
+
+	lconn, err := listen(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	ttl := t.cfg.TTL
+	if ttl <= 0 {
+		ttl = 1
+	}
+	if err := setMulticastOptions(lconn, ipv6, ifi, ttl, t.cfg.Loopback); err != nil {
+		lconn.Close()
+		return nil, fmt.Errorf("setting multicast options: %v", err)
+	}
+
+	bconn, err := net.ListenMulticastUDP(network, ifi, gaddr)
+	if err != nil {
+		lconn.Close()
+		return nil, err
+	}
+
+	return &sockets{laddr: laddr, baddr: gaddr, lconn: lconn, bconn: bconn, failed: make(chan struct{})}, nil
+}
@@ -1,125 +1,345 @@
 package udp
 
 import (
+	"errors"
 	"fmt"
 	"net"
-	"strconv"
+	"sync"
+	"time"
 )
 
-var laddr *net.UDPAddr //Local address
-var baddr *net.UDPAddr //Broadcast address
-
 type Udp_message struct {
 	Raddr  string //if receiving raddr=senders address, if sending raddr should be set to "broadcast" or an ip:port
 	Data   string //TODO: implement another encoding, strings are meh
 	Length int    //length of received data, in #bytes // N/A for sending
 }
 
-func Udp_init(localListenPort, broadcastListenPort, message_size int, send_ch, receive_ch chan Udp_message) (err error) {
-	//Generating broadcast address
-	baddr, err = net.ResolveUDPAddr("udp4", "255.255.255.255:"+strconv.Itoa(broadcastListenPort))
+// Reopen backoff. Starts at the minimum and doubles for every failed attempt.
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 5 * time.Second
+)
+
+// How often we check that the local address is still ours, e.g. after the interface went down
+const checkInterval = 2 * time.Second
+
+// Config says where to send and listen
+type Config struct {
+	// Interface to send and listen on. If empty, whichever the OS routes the broadcast address through.
+	Interface string
+	// Broadcast address. If empty, the interface's directed broadcast address if Interface is set,
+	// otherwise 255.255.255.255.
+	Broadcast string
+
+	// Multicast group, IPv4 or IPv6. If set, it is used instead of broadcast.
+	Multicast string
+	// TTL, or hop limit, of multicast messages. 1 stays on the local network.
+	TTL int
+	// Loopback delivers our multicast messages to this machine too. Needed for several elevators on one machine.
+	Loopback bool
+
+	LocalPort     int // Port we send from, and listen for unicast on
+	BroadcastPort int // Port broadcasts go to
+	MessageSize   int // Longest message we can receive
+}
+
+// Transport sends and receives broadcasts, and reopens its sockets when anything goes wrong.
+// Messages sent while offline are dropped.
+type Transport struct {
+	cfg Config
+
+	send_ch, receive_ch chan Udp_message
+
+	// Errors reports I/O errors, which the transport recovers from by itself. Dropped if nobody listens.
+	Errors <-chan error
+	errCh  chan error
+
+	// Connectivity gets the new state every time the transport goes online or offline
+	Connectivity <-chan bool
+	onlineCh     chan bool
+
+	mutex         sync.Mutex
+	online, known bool
+}
+
+// sockets is one generation of open connections. When anything fails, they are all closed and a new generation is opened.
+type sockets struct {
+	laddr, baddr *net.UDPAddr
+	lconn, bconn *net.UDPConn
+	failed       chan struct{}
+	once         sync.Once
+}
+
+func (s *sockets) fail() {
+	s.once.Do(func() {
+		close(s.failed)
+		s.lconn.Close()
+		s.bconn.Close()
+	})
+}
+
+func Udp_init(cfg Config, send_ch, receive_ch chan Udp_message) *Transport {
+	t := &Transport{
+		cfg:        cfg,
+		send_ch:    send_ch,
+		receive_ch: receive_ch,
+		errCh:      make(chan error, 8),
+		onlineCh:   make(chan bool, 8),
+	}
+	t.Errors = t.errCh
+	t.Connectivity = t.onlineCh
+
+	go t.run()
+	return t
+}
+
+// Online is true while the sockets are open and working
+func (t *Transport) Online() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.online
+}
+
+func (t *Transport) setOnline(online bool) {
+	t.mutex.Lock()
+	changed := t.online != online || !t.known
+	t.online, t.known = online, true
+	t.mutex.Unlock()
+	if changed {
+		t.onlineCh <- online
+	}
+}
+
+func (t *Transport) report(err error) {
+	select {
+	case t.errCh <- err:
+	default:
+	}
+}
+
+// interfaceByName is net.InterfaceByName, but errors if the interface is down
+func interfaceByName(name string) (*net.Interface, error) {
+	ifi, err := net.InterfaceByName(name)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if ifi.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("interface %s is down", name)
+	}
+	return ifi, nil
+}
+
+// interfaceNet gives the IPv4 network of an interface. Errors if it is down or has no IPv4 address.
+func interfaceNet(name string) (*net.IPNet, error) {
+	ifi, err := interfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no IPv4 address", name)
+}
+
+// broadcastAddr works out where broadcasts go
+func (t *Transport) broadcastAddr() (*net.UDPAddr, error) {
+	ip := net.IPv4bcast
+	if t.cfg.Broadcast != "" {
+		if ip = net.ParseIP(t.cfg.Broadcast).To4(); ip == nil {
+			return nil, fmt.Errorf("%q is not an IPv4 address", t.cfg.Broadcast)
+		}
+	} else if t.cfg.Interface != "" {
+		ipnet, err := interfaceNet(t.cfg.Interface)
+		if err != nil {
+			return nil, err
+		}
+		// Directed broadcast, all host bits set
+		ip = make(net.IP, net.IPv4len)
+		for i := range ip {
+			ip[i] = ipnet.IP.To4()[i] | ^ipnet.Mask[len(ipnet.Mask)-net.IPv4len+i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: t.cfg.BroadcastPort}, nil
+}
+
+// localAddr finds the address we send from. Without an interface, ask the OS for a route to the broadcast address.
+func (t *Transport) localAddr(baddr *net.UDPAddr) (*net.UDPAddr, error) {
+	if t.cfg.Interface != "" {
+		ipnet, err := interfaceNet(t.cfg.Interface)
+		if err != nil {
+			return nil, err
+		}
+		return &net.UDPAddr{IP: ipnet.IP.To4(), Port: t.cfg.LocalPort}, nil
 	}
 
-	//Generating localaddress
 	tempConn, err := net.DialUDP("udp4", nil, baddr)
+	if err != nil {
+		return nil, err
+	}
 	defer tempConn.Close()
-	tempAddr := tempConn.LocalAddr()
-	laddr, err = net.ResolveUDPAddr("udp4", tempAddr.String())
-	laddr.Port = localListenPort
+	laddr, err := net.ResolveUDPAddr("udp4", tempConn.LocalAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	laddr.Port = t.cfg.LocalPort
+	return laddr, nil
+}
+
+func (t *Transport) open() (*sockets, error) {
+	if t.cfg.Multicast != "" {
+		return t.openMulticast()
+	}
+
+	//Generating broadcast address
+	baddr, err := t.broadcastAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	//Generating localaddress
+	laddr, err := t.localAddr(baddr)
+	if err != nil {
+		return nil, err
+	}
 
 	//Creating local listening connections
-	localListenConn, err := net.ListenUDP("udp4", laddr)
+	lconn, err := listen("udp4", laddr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	//Creating listener on broadcast connection
-	broadcastListenConn, err := net.ListenUDP("udp", baddr)
+	bconn, err := listen("udp4", baddr)
 	if err != nil {
-		localListenConn.Close()
-		return err
+		lconn.Close()
+		return nil, err
 	}
 
-	go udp_receive_server(localListenConn, broadcastListenConn, message_size, receive_ch)
-	go udp_transmit_server(localListenConn, broadcastListenConn, send_ch)
-	return err
+	return &sockets{laddr: laddr, baddr: baddr, lconn: lconn, bconn: bconn, failed: make(chan struct{})}, nil
 }
 
-func udp_transmit_server(lconn, bconn *net.UDPConn, send_ch chan Udp_message) {
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Printf("ERROR in udp_transmit_server: %s \n Closing connection.\n", r)
-			lconn.Close()
-			bconn.Close()
+// check that the sockets are still good, e.g. that the interface is up and has the same address
+func (t *Transport) check(s *sockets) error {
+	if t.cfg.Multicast != "" {
+		if t.cfg.Interface != "" {
+			_, err := interfaceByName(t.cfg.Interface)
+			return err
 		}
-	}()
+		return nil
+	}
 
-	var err error
-	var n int
+	laddr, err := t.localAddr(s.baddr)
+	if err != nil {
+		return err
+	}
+	if !laddr.IP.Equal(s.laddr.IP) {
+		return fmt.Errorf("local address changed from %v to %v", s.laddr.IP, laddr.IP)
+	}
+	return nil
+}
 
+// run keeps the sockets open, and sends while they are
+func (t *Transport) run() {
+	backoff := minBackoff
 	for {
-		msg := <-send_ch
-		if msg.Raddr == "broadcast" {
-			n, err = lconn.WriteToUDP([]byte(msg.Data), baddr)
+		s, err := t.open()
+		if err != nil {
+			t.report(fmt.Errorf("udp: opening sockets: %v, retrying in %v", err, backoff))
 		} else {
-			raddr, err := net.ResolveUDPAddr("udp", msg.Raddr)
-			if err != nil {
-				fmt.Println("Error: udp_transmit_server: could not resolve raddr.")
-				panic(err)
+			t.setOnline(true)
+			opened := time.Now()
+
+			go t.read(s, s.lconn)
+			go t.read(s, s.bconn)
+			t.transmit(s)
+
+			// Only start over from a short wait if they worked for a while, or we'd spin on a broken network
+			if time.Since(opened) > maxBackoff {
+				backoff = minBackoff
 			}
-			n, err = lconn.WriteToUDP([]byte(msg.Data), raddr)
 		}
-		if err != nil || n < 0 {
-			fmt.Println("Error: udp_transmit_server: writing.")
-			panic(err)
+
+		t.setOnline(false)
+		t.dropFor(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
 		}
 	}
 }
 
-func udp_receive_server(lconn, bconn *net.UDPConn, message_size int, receive_ch chan Udp_message) {
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Printf("ERROR in udp_receive_server: %s \n Closing connection.\n", r)
-			lconn.Close()
-			bconn.Close()
+// dropFor throws away whatever is sent while offline
+func (t *Transport) dropFor(d time.Duration) {
+	timeout := time.After(d)
+	for {
+		select {
+		case <-t.send_ch:
+		case <-timeout:
+			return
 		}
-	}()
-
-	bconn_rcv_ch := make(chan Udp_message)
-	lconn_rcv_ch := make(chan Udp_message)
+	}
+}
 
-	go udp_connection_reader(lconn, message_size, lconn_rcv_ch)
-	go udp_connection_reader(bconn, message_size, bconn_rcv_ch)
+// transmit sends until the sockets fail, or the local address goes away
+func (t *Transport) transmit(s *sockets) {
+	check := time.NewTicker(checkInterval)
+	defer check.Stop()
 
 	for {
 		select {
+		case <-s.failed:
+			return
 
-		case buf := <-bconn_rcv_ch:
-			receive_ch <- buf
+		case <-check.C:
+			if err := t.check(s); err != nil {
+				t.report(fmt.Errorf("udp: %v, reopening", err))
+				s.fail()
+				return
+			}
 
-		case buf := <-lconn_rcv_ch:
-			receive_ch <- buf
+		case msg := <-t.send_ch:
+			var raddr *net.UDPAddr
+			var err error
+			if msg.Raddr == "broadcast" {
+				raddr = s.baddr
+			} else if raddr, err = net.ResolveUDPAddr("udp", msg.Raddr); err != nil {
+				// Their problem, not ours
+				t.report(fmt.Errorf("udp: could not resolve %q: %v", msg.Raddr, err))
+				continue
+			}
+
+			if _, err = s.lconn.WriteToUDP([]byte(msg.Data), raddr); err != nil {
+				t.report(fmt.Errorf("udp: writing: %v, reopening", err))
+				s.fail()
+				return
+			}
 		}
 	}
 }
 
-func udp_connection_reader(conn *net.UDPConn, message_size int, rcv_ch chan Udp_message) {
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Printf("ERROR in udp_connection_reader: %s \n Closing connection.\n", r)
-			conn.Close()
-		}
-	}()
-
+// read passes on everything received on conn until the sockets fail
+func (t *Transport) read(s *sockets, conn *net.UDPConn) {
 	for {
-		buf := make([]byte, message_size)
+		buf := make([]byte, t.cfg.MessageSize)
 		n, raddr, err := conn.ReadFromUDP(buf)
-		if err != nil || n < 0 {
-			fmt.Printf("Error: udp_connection_reader: reading\n")
-			panic(err)
+		if err != nil {
+			select {
+			case <-s.failed:
+				// Closed on purpose
+			default:
+				if !errors.Is(err, net.ErrClosed) {
+					t.report(fmt.Errorf("udp: reading: %v, reopening", err))
+				}
+				s.fail()
+			}
+			return
 		}
-		rcv_ch <- Udp_message{Raddr: raddr.String(), Data: string(buf), Length: n}
+		t.receive_ch <- Udp_message{Raddr: raddr.String(), Data: string(buf), Length: n}
 	}
 }
@@ -0,0 +1,169 @@
+package queue
+
+import (
+	"sync"
+	"time"
+
+	"github.com/knutaldrin/elevator/driver"
+	"github.com/knutaldrin/elevator/log"
+	"github.com/knutaldrin/elevator/net"
+)
+
+/** ASSIGNMENT
+ * Every elevator hears of every hall order, and opens it: asks its Assigner how long to wait, then
+ * whether to take it. The one that takes it sends AC, and the others stand back. If nobody has taken
+ * it after timeoutDelay, the one that did is lost or gives it back, or doesn't serve it in the time it bid
+ * (or any elevator could take, if it didn't bid) and acceptMargin, the order is opened again.
+ *
+ * Every elevator in a group must use the same strategy, or they won't agree on much.
+ */
+
+// Assigner decides which elevator takes a hall order
+type Assigner interface {
+	// Open is called when a hall order or destination call is up for grabs. eta is how long until we could
+	// serve it, negative if we're out of service. Decide is called after the returned delay. Anything to tell
+	// the others goes with send, which is not to be held up: it goes out once the queue lets go of its lock.
+	Open(k Key, eta time.Duration, send func(net.OrderMessage)) time.Duration
+	// Bid is called with what another elevator says the order would cost it
+	Bid(k Key, id uint, cost uint32)
+	// Decide is true if we should take the order
+	Decide(k Key) bool
+}
+
+// Bid is called when another elevator bids on a hall order or destination call
+func (q *Queue) Bid(floor driver.Floor, dir driver.Direction, call *net.CallID, id uint, cost uint32) {
+	k := q.keyOf(floor, dir, call)
+	q.cfg.Assigner.Bid(k, id, cost)
+
+	// Should it win, it has said how long to wait for it
+	q.mutex.Lock()
+	defer q.unlock()
+	if o := q.find(k); o != nil {
+		v := o.Value.(*order)
+		if v.bids == nil {
+			v.bids = make(map[uint]time.Duration)
+		}
+		v.bids[id] = time.Duration(cost) * time.Millisecond
+	}
+}
+
+// TimerAssigner is first come, first served. Everyone waits longer the worse placed they are, and the first to
+// run out takes the order. Cheap, but two elevators that are about as well placed may both take it.
+type TimerAssigner struct {
+	ID        uint
+	FloorTime time.Duration
+}
+
+// Open waits delayUnit per floor's worth of time until we could serve it, and a little more by ID, so
+// equally placed elevators don't go at once
+func (a TimerAssigner) Open(k Key, eta time.Duration, send func(net.OrderMessage)) time.Duration {
+	if eta < 0 {
+		return timeoutDelay
+	}
+	delay := time.Duration(float64(delayUnit) * float64(eta) / float64(a.FloorTime))
+	return delay + delayUnit*time.Duration(a.ID%32)/32
+}
+
+// Bid is ignored, nobody bids
+func (TimerAssigner) Bid(k Key, id uint, cost uint32) {}
+
+// Decide is always yes, the others would have said so by now if they took it
+func (TimerAssigner) Decide(k Key) bool {
+	return true
+}
+
+// CostAssigner is an auction. Everyone in service bids what the order would cost them, waits for the other
+// bids, and the lowest cost takes it, lowest ID on a tie. Everyone gets the same bids, so everyone agrees.
+type CostAssigner struct {
+	ID     uint
+	Window time.Duration // How long to wait for bids
+
+	peers func() []net.Peer
+
+	mutex *sync.Mutex
+	bids  map[Key]map[uint]bid
+}
+
+type bid struct {
+	cost uint32
+	at   time.Time
+}
+
+// NewCostAssigner waits window for bids. peers tells who may win.
+func NewCostAssigner(id uint, window time.Duration, peers func() []net.Peer) *CostAssigner {
+	return &CostAssigner{
+		ID:     id,
+		Window: window,
+		peers:  peers,
+		mutex:  &sync.Mutex{},
+		bids:   make(map[Key]map[uint]bid),
+	}
+}
+
+// Open bids the time until we could serve it in milliseconds, if we are in service
+func (a *CostAssigner) Open(k Key, eta time.Duration, send func(net.OrderMessage)) time.Duration {
+	if eta >= 0 {
+		c := uint32(eta / time.Millisecond)
+		a.Bid(k, a.ID, c)
+		send(net.BidMessage(k.Floor, k.Dir, k.call(), c))
+	}
+	return a.Window
+}
+
+// Bid remembers a bid
+func (a *CostAssigner) Bid(k Key, id uint, cost uint32) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.prune()
+	if a.bids[k] == nil {
+		a.bids[k] = make(map[uint]bid)
+	}
+	a.bids[k][id] = bid{cost: cost, at: time.Now()}
+}
+
+// prune forgets auctions nobody decided, e.g. late bids or orders completed within the window.
+// Decide would ignore their bids anyway. Must hold mutex.
+func (a *CostAssigner) prune() {
+	for k, bids := range a.bids {
+		stale := true
+		for _, b := range bids {
+			if time.Since(b.at) <= 2*a.Window {
+				stale = false
+				break
+			}
+		}
+		if stale {
+			delete(a.bids, k)
+		}
+	}
+}
+
+// Decide is true if our bid is the best one from an elevator that is still around and in service
+func (a *CostAssigner) Decide(k Key) bool {
+	eligible := map[uint]bool{a.ID: true}
+	for _, p := range a.peers() {
+		eligible[p.ID] = p.InService
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	bids := a.bids[k]
+	delete(a.bids, k)
+
+	var winner uint
+	var best bid
+	found := false
+	for id, b := range bids {
+		if !eligible[id] || time.Since(b.at) > 2*a.Window {
+			// Gone, out of service, or left over from an earlier round
+			continue
+		}
+		if !found || b.cost < best.cost || (b.cost == best.cost && id < winner) {
+			winner, best, found = id, b, true
+		}
+	}
+	if found && winner != a.ID {
+		log.With("elevator", a.ID, "floor", k.Floor, "dir", k.Dir, "winner", winner, "cost", best.cost).Debug("Elevator ", winner, " wins the order")
+	}
+	return found && winner == a.ID
+}
@@ -0,0 +1,113 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/knutaldrin/elevator/driver"
+	"github.com/knutaldrin/elevator/net"
+)
+
+// newTestAssigner is elevator id, with the given peers around
+func newTestAssigner(id uint, peers ...net.Peer) *CostAssigner {
+	return NewCostAssigner(id, 50*time.Millisecond, func() []net.Peer { return peers })
+}
+
+func peer(id uint, inService bool) net.Peer {
+	return net.Peer{ID: id, Status: net.Status{InService: inService}}
+}
+
+func TestDecideLowestCost(t *testing.T) {
+	a := newTestAssigner(2, peer(1, true), peer(3, true))
+	a.Bid(Key{Floor: 2, Dir: driver.DirectionUp}, 2, 3)
+	a.Bid(Key{Floor: 2, Dir: driver.DirectionUp}, 1, 4)
+	a.Bid(Key{Floor: 2, Dir: driver.DirectionUp}, 3, 2)
+	if a.Decide(Key{Floor: 2, Dir: driver.DirectionUp}) {
+		t.Fatal("took it at 3 with a bid of 2")
+	}
+
+	a.Bid(Key{Floor: 2, Dir: driver.DirectionUp}, 2, 1)
+	a.Bid(Key{Floor: 2, Dir: driver.DirectionUp}, 1, 4)
+	a.Bid(Key{Floor: 2, Dir: driver.DirectionUp}, 3, 2)
+	if !a.Decide(Key{Floor: 2, Dir: driver.DirectionUp}) {
+		t.Fatal("didn't take it with the lowest bid")
+	}
+}
+
+func TestDecideTieGoesToLowestID(t *testing.T) {
+	a := newTestAssigner(2, peer(1, true), peer(3, true))
+	for id := uint(1); id <= 3; id++ {
+		a.Bid(Key{Floor: 1, Dir: driver.DirectionDown}, id, 1)
+	}
+	if a.Decide(Key{Floor: 1, Dir: driver.DirectionDown}) {
+		t.Fatal("2 took a tie with 1")
+	}
+
+	a = newTestAssigner(1, peer(2, true))
+	a.Bid(Key{Floor: 1, Dir: driver.DirectionDown}, 1, 1)
+	a.Bid(Key{Floor: 1, Dir: driver.DirectionDown}, 2, 1)
+	if !a.Decide(Key{Floor: 1, Dir: driver.DirectionDown}) {
+		t.Fatal("1 didn't take a tie with 2")
+	}
+}
+
+func TestDecideIgnoresIneligible(t *testing.T) {
+	a := newTestAssigner(2, peer(1, false))
+	a.Bid(Key{Floor: 1, Dir: driver.DirectionUp}, 2, 10)
+	a.Bid(Key{Floor: 1, Dir: driver.DirectionUp}, 1, 0) // Out of service
+	a.Bid(Key{Floor: 1, Dir: driver.DirectionUp}, 4, 0) // Not a peer
+	if !a.Decide(Key{Floor: 1, Dir: driver.DirectionUp}) {
+		t.Fatal("lost to elevators that can't take it")
+	}
+
+	// No bid of ours, nobody wins
+	a.Bid(Key{Floor: 1, Dir: driver.DirectionUp}, 1, 0)
+	if a.Decide(Key{Floor: 1, Dir: driver.DirectionUp}) {
+		t.Fatal("took it without bidding")
+	}
+}
+
+func TestDecideIgnoresStaleBids(t *testing.T) {
+	a := newTestAssigner(2, peer(1, true))
+	a.Bid(Key{Floor: 3, Dir: driver.DirectionDown}, 1, 0) // Left over from an earlier round
+	time.Sleep(2*a.Window + 10*time.Millisecond)
+
+	a.Bid(Key{Floor: 3, Dir: driver.DirectionDown}, 2, 5)
+	if !a.Decide(Key{Floor: 3, Dir: driver.DirectionDown}) {
+		t.Fatal("lost to a bid from an earlier round")
+	}
+}
+
+func TestDecideKeepsCallsApart(t *testing.T) {
+	a := newTestAssigner(2, peer(1, true))
+	hall := Key{Floor: 1, Dir: driver.DirectionUp}
+	call := Key{Floor: 1, Dir: driver.DirectionUp, IsCall: true, Call: net.CallID{Caller: 60000, Seq: 7}}
+	a.Bid(hall, 2, 5)
+	a.Bid(hall, 1, 9)
+	a.Bid(call, 2, 5)
+	a.Bid(call, 1, 0)
+	if !a.Decide(hall) {
+		t.Error("lost the hall order to a bid on a destination call")
+	}
+	if a.Decide(call) {
+		t.Error("took the destination call with the higher bid")
+	}
+}
+
+func TestBidsArePruned(t *testing.T) {
+	a := newTestAssigner(1, peer(2, true))
+	for seq := uint32(0); seq < 10; seq++ {
+		// Late bids on destination calls that are long gone
+		a.Bid(Key{Floor: 1, Dir: driver.DirectionUp, IsCall: true, Call: net.CallID{Caller: 60000, Seq: seq}}, 2, 100)
+	}
+	time.Sleep(2*a.Window + 10*time.Millisecond)
+
+	k := Key{Floor: 2, Dir: driver.DirectionUp}
+	a.Open(k, time.Second, func(net.OrderMessage) {})
+	a.mutex.Lock()
+	n := len(a.bids)
+	a.mutex.Unlock()
+	if n != 1 {
+		t.Fatalf("%d auctions remembered, expected only the open one", n)
+	}
+}
@@ -0,0 +1,58 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/knutaldrin/elevator/driver"
+)
+
+// timeToServe estimates how long until we would stop for a hall order if we took it now. It runs the car forward
+// the way NextDirection and ShouldStop would, with the order added to the stops we already have.
+func (q *Queue) timeToServe(floor driver.Floor, dir driver.Direction) time.Duration {
+	dir = q.hallDir(floor, dir)
+
+	var stops [3][]bool
+	for d := range q.shouldStop {
+		stops[d] = append([]bool(nil), q.shouldStop[d]...)
+	}
+	stops[dir][floor] = true
+
+	at, going := q.currentFloor, q.currentDir
+	var t time.Duration
+	if q.doorOpen {
+		// Don't know how long it has been open, guess half way
+		t += q.cfg.DoorTime / 2
+	}
+
+	// Every round clears a stop, or goes to an end floor and turns. Give up on anything that takes longer.
+	for round := 0; round < 4*int(q.cfg.NumFloors); round++ {
+		next := q.nextDirection(at, going, &stops)
+		if next == driver.DirectionNone {
+			// Only stops left are where we are
+			return t
+		}
+
+		for {
+			if next == driver.DirectionUp {
+				at++
+			} else {
+				at--
+			}
+			t += q.cfg.FloorTime
+			if q.stopAt(at, next, &stops) {
+				break
+			}
+		}
+
+		// Same as ClearOrderLocal
+		stops[driver.DirectionNone][at] = false
+		cleared := q.hallDir(at, next)
+		stops[cleared][at] = false
+		if at == floor && cleared == dir {
+			return t
+		}
+		t += q.cfg.DoorTime
+		going = next
+	}
+	return t
+}
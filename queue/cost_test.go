@@ -0,0 +1,48 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/knutaldrin/elevator/driver"
+)
+
+func TestTimeToServe(t *testing.T) {
+	tests := []struct {
+		name     string
+		at       driver.Floor
+		going    driver.Direction
+		cab      []driver.Floor
+		doorOpen bool
+		floor    driver.Floor
+		dir      driver.Direction
+		want     time.Duration
+	}{
+		{"idle, on the way", 0, driver.DirectionNone, nil, false, 2, driver.DirectionUp, 2 * time.Second},
+		// Doesn't stop for a down order going up: to the top, door, back down one
+		{"idle, other way", 0, driver.DirectionNone, nil, false, 2, driver.DirectionDown, 7 * time.Second},
+		{"door open", 0, driver.DirectionNone, nil, true, 2, driver.DirectionUp, 3500 * time.Millisecond},
+		{"stop on the way", 0, driver.DirectionUp, []driver.Floor{1}, false, 2, driver.DirectionUp, 5 * time.Second},
+		{"top floor is up", 0, driver.DirectionNone, nil, false, 3, driver.DirectionDown, 3 * time.Second},
+		{"here", 1, driver.DirectionNone, nil, false, 1, driver.DirectionUp, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue(t)
+			q.Update(tt.at)
+			q.currentDir = tt.going
+			for _, f := range tt.cab {
+				q.NewOrder(f, driver.DirectionNone)
+			}
+			q.SetDoorOpen(tt.doorOpen)
+
+			q.mutex.Lock()
+			got := q.timeToServe(tt.floor, tt.dir)
+			q.mutex.Unlock()
+			if got != tt.want {
+				t.Errorf("timeToServe(%d, %v) = %v, expected %v", tt.floor, tt.dir, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package queue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/knutaldrin/elevator/driver"
+	"github.com/knutaldrin/elevator/journal"
+	"github.com/knutaldrin/elevator/log"
+	"github.com/knutaldrin/elevator/net"
+	"github.com/knutaldrin/elevator/store"
+)
+
+// Entry is a change to the orders we are responsible for: a cab order, or a hall order or destination call
+// we accepted, taken or done with
+type Entry struct {
+	Done  bool // Served, or handed to someone else
+	Floor driver.Floor
+	Dir   driver.Direction // DirectionNone for cab orders
+	Call  *net.CallID      // Destination calls only
+	Dest  driver.Floor
+}
+
+func (e Entry) key() Key {
+	return keyOf(e.Floor, e.Dir, e.Call)
+}
+
+// OrderLog keeps the orders we are responsible for over restarts
+type OrderLog interface {
+	// Record a change. Failing to is the log's to report, the elevator runs on without it.
+	Record(e Entry)
+	// Recover what we were responsible for when we last ran
+	Recover() []Entry
+}
+
+// journalSchema is the version of the journal records. Bump it when they change.
+const journalSchema = 1
+
+/** JOURNAL RECORD
+ * 1 byte: done (0/1)
+ * 2 bytes: floor
+ * 1 byte: direction
+ * 1 byte: destination call (0/1), then if set:
+ * 2 bytes: keypad ID
+ * 4 bytes: sequence number of the DC
+ * 2 bytes: destination
+ */
+
+func encodeEntry(e Entry) []byte {
+	buf := []byte{b2byte(e.Done)}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(e.Floor))
+	buf = append(buf, byte(e.Dir), b2byte(e.Call != nil))
+	if e.Call != nil {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(e.Call.Caller))
+		buf = binary.BigEndian.AppendUint32(buf, e.Call.Seq)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(e.Dest))
+	}
+	return buf
+}
+
+func decodeEntry(buf []byte) (Entry, error) {
+	if len(buf) < 5 {
+		return Entry{}, fmt.Errorf("record is %d bytes", len(buf))
+	}
+	e := Entry{
+		Done:  buf[0] != 0,
+		Floor: driver.Floor(binary.BigEndian.Uint16(buf[1:])),
+		Dir:   driver.Direction(buf[3]),
+	}
+	if e.Dir > driver.DirectionNone {
+		return Entry{}, fmt.Errorf("direction %d", e.Dir)
+	}
+	switch {
+	case buf[4] == 0 && len(buf) == 5:
+	case buf[4] != 0 && len(buf) == 13:
+		e.Call = &net.CallID{Caller: uint(binary.BigEndian.Uint16(buf[5:])), Seq: binary.BigEndian.Uint32(buf[7:])}
+		e.Dest = driver.Floor(binary.BigEndian.Uint16(buf[11:]))
+	default:
+		return Entry{}, fmt.Errorf("record is %d bytes", len(buf))
+	}
+	return e, nil
+}
+
+func b2byte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Compact the journal when it has this many records and most of them are history
+const compactMin = 64
+
+// JournalLog is an OrderLog in a journal. It keeps the entries that still count, and compacts the
+// journal down to them now and then.
+type JournalLog struct {
+	mutex sync.Mutex
+	j     *journal.Journal
+	live  map[Key]Entry
+	order []Key // of live, oldest first
+}
+
+// OpenJournalLog opens the journal at path, or starts a new one. A journal we can't make sense of
+// gives a store.CorruptError.
+func OpenJournalLog(path string, opts journal.Options) (*JournalLog, error) {
+	opts.Schema = journalSchema
+	j, records, err := journal.Open(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &JournalLog{j: j, live: make(map[Key]Entry)}
+	for i, r := range records {
+		e, err := decodeEntry(r)
+		if err != nil {
+			j.Close()
+			return nil, &store.CorruptError{Path: path, Reason: fmt.Sprint("record ", i+1, ": ", err)}
+		}
+		l.apply(e)
+	}
+	log.Info("Journal ", path, ": ", len(records), " records, ", len(l.live), " orders outstanding")
+	l.compact()
+	return l, nil
+}
+
+// apply an entry to what counts. Must hold mutex.
+func (l *JournalLog) apply(e Entry) {
+	k := e.key()
+	_, had := l.live[k]
+	if e.Done {
+		if had {
+			delete(l.live, k)
+			for i := range l.order {
+				if l.order[i] == k {
+					l.order = append(l.order[:i], l.order[i+1:]...)
+					break
+				}
+			}
+		}
+		return
+	}
+	if !had {
+		l.order = append(l.order, k)
+	}
+	l.live[k] = e
+}
+
+// compact the journal down to what counts. Must hold mutex.
+func (l *JournalLog) compact() {
+	records := make([][]byte, len(l.order))
+	for i, k := range l.order {
+		records[i] = encodeEntry(l.live[k])
+	}
+	if err := l.j.Compact(records); err != nil {
+		log.Error("Compacting the order journal: ", err)
+	}
+}
+
+// Record an entry
+func (l *JournalLog) Record(e Entry) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.apply(e)
+	if err := l.j.Append(encodeEntry(e)); err != nil {
+		log.Error("Logging order: ", err)
+		return
+	}
+	if n := l.j.Len(); n >= compactMin && n > 4*len(l.live) {
+		l.compact()
+	}
+}
+
+// Recover gives the entries that count, oldest first
+func (l *JournalLog) Recover() []Entry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entries := make([]Entry, len(l.order))
+	for i, k := range l.order {
+		entries[i] = l.live[k]
+	}
+	return entries
+}
+
+// Close the journal
+func (l *JournalLog) Close() error {
+	return l.j.Close()
+}
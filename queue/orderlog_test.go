@@ -0,0 +1,64 @@
+package queue
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/knutaldrin/elevator/driver"
+	"github.com/knutaldrin/elevator/journal"
+	"github.com/knutaldrin/elevator/net"
+)
+
+func TestEntryRoundTrip(t *testing.T) {
+	entries := []Entry{
+		{Floor: 3, Dir: driver.DirectionNone},
+		{Done: true, Floor: 1, Dir: driver.DirectionUp},
+		{Floor: 2, Dir: driver.DirectionDown, Call: &net.CallID{Caller: 60000, Seq: 0xfffffffe}, Dest: 0},
+	}
+	for _, e := range entries {
+		got, err := decodeEntry(encodeEntry(e))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, e) {
+			t.Errorf("got %+v, expected %+v", got, e)
+		}
+	}
+
+	for _, buf := range [][]byte{{0, 0, 1, 0}, {0, 0, 1, 3, 0}, {0, 0, 1, 0, 1, 0, 0}} {
+		if e, err := decodeEntry(buf); err == nil {
+			t.Errorf("%v decoded as %+v", buf, e)
+		}
+	}
+}
+
+func TestJournalLogRecover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orders")
+	l, err := OpenJournalLog(path, journal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := &net.CallID{Caller: 60000, Seq: 1}
+	l.Record(Entry{Floor: 2, Dir: driver.DirectionNone})
+	l.Record(Entry{Floor: 1, Dir: driver.DirectionUp})
+	l.Record(Entry{Floor: 3, Dir: driver.DirectionDown, Call: call, Dest: 0})
+	l.Record(Entry{Done: true, Floor: 1, Dir: driver.DirectionUp})
+	l.Record(Entry{Floor: 2, Dir: driver.DirectionNone}) // Pressed again
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = OpenJournalLog(path, journal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	want := []Entry{
+		{Floor: 2, Dir: driver.DirectionNone},
+		{Floor: 3, Dir: driver.DirectionDown, Call: call, Dest: 0},
+	}
+	if got := l.Recover(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("recovered %+v, expected %+v", got, want)
+	}
+}
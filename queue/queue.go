@@ -2,6 +2,7 @@ package queue
 
 import (
 	"container/list"
+	"sync"
 	"time"
 
 	"github.com/knutaldrin/elevator/driver"
@@ -12,89 +13,293 @@ import (
 const timeoutDelay = time.Second * 10
 const delayUnit = time.Millisecond * 60
 
-var elevID uint
+// acceptMargin is how much longer than it said it would take an elevator gets to serve an order it accepted
+const acceptMargin = time.Second * 10
+
+// DefaultFloorTime is how long the lab elevator takes from one floor to the next
+const DefaultFloorTime = 2 * time.Second
+
+// DefaultDoorTime is how long a stop takes, from the door opening until it has closed again
+const DefaultDoorTime = 3 * time.Second
+
+// Config is who a Queue belongs to, and how it reaches the world outside
+type Config struct {
+	ID        uint
+	NumFloors driver.Floor
+	// FloorTime and DoorTime are for estimating when orders get served. Zero for the defaults.
+	FloorTime, DoorTime time.Duration
+	// Assigner decides who takes hall orders. Nil for a TimerAssigner.
+	Assigner Assigner
+	// Lamp turns a button lamp on or off. Nil for no lamps.
+	Lamp func(floor driver.Floor, dir driver.Direction, on bool)
+	// Send tells the other elevators. Nil for nobody to tell.
+	Send func(net.OrderMessage)
+	// Timeout is pinged when the elevator should wake and look for something to do
+	Timeout chan<- bool
+	// OrderLog keeps our orders over restarts. Nil to forget them.
+	OrderLog OrderLog
+}
+
+// Queue is the orders of one elevator, and what it knows of the others' hall orders. Safe for concurrent use,
+// as the order timers run on their own.
+type Queue struct {
+	cfg   Config
+	mutex sync.Mutex
+
+	// Messages are sent after letting go of mutex, so a slow network doesn't hold up the queue. sendMutex
+	// keeps them in order.
+	outbox    []net.OrderMessage
+	sendMutex sync.Mutex
+
+	shouldStop   [3][]bool
+	currentFloor driver.Floor
+	currentDir   driver.Direction
+
+	pendingOrders *list.List
 
-var shouldStop [3][driver.NumFloors]bool
+	// Out of service elevators don't accept hall orders
+	inService bool
+
+	// Without a network we're on our own, and take every hall order at once
+	offline bool
+
+	doorOpen bool
+
+	log *log.Logger
+}
 
 type order struct {
-	floor driver.Floor
-	dir   driver.Direction
-	timer *time.Timer
+	floor    driver.Floor
+	dir      driver.Direction
+	timer    *time.Timer
+	deadline time.Time // When the timer should run out, to tell if it was reset after it fired
+	accepted bool      // by owner
+	owner    uint
+	open     bool // Up for grabs, the assigner decides when the timer runs out
+	claim    bool // Ours without asking the assigner
+
+	bids map[uint]time.Duration // The time to serve others bid, since it was last opened
+
+	call *net.CallID // Destination calls only
+	dest driver.Floor
+}
+
+// Key identifies a hall order or a destination call
+type Key struct {
+	Floor  driver.Floor
+	Dir    driver.Direction
+	IsCall bool
+	Call   net.CallID
 }
 
-var currentFloor driver.Floor
-var currentDir = driver.DirectionNone
+func (k Key) call() *net.CallID {
+	if !k.IsCall {
+		return nil
+	}
+	return &k.Call
+}
+
+func (o *order) key() Key {
+	return keyOf(o.floor, o.dir, o.call)
+}
 
-var pendingOrders = list.New()
+// New queue, with nothing to do
+func New(cfg Config) *Queue {
+	if cfg.FloorTime == 0 {
+		cfg.FloorTime = DefaultFloorTime
+	}
+	if cfg.DoorTime == 0 {
+		cfg.DoorTime = DefaultDoorTime
+	}
+	if cfg.Assigner == nil {
+		cfg.Assigner = TimerAssigner{ID: cfg.ID, FloorTime: cfg.FloorTime}
+	}
 
-var timeoutCh chan<- bool
+	q := &Queue{cfg: cfg, currentDir: driver.DirectionNone, pendingOrders: list.New(), inService: true}
+	q.log = log.With("elevator", cfg.ID)
+	for i := range q.shouldStop {
+		q.shouldStop[i] = make([]bool, cfg.NumFloors)
+	}
+	return q
+}
 
-// SetID sets elevator ID
-func SetID(id uint) {
-	elevID = id
+func (q *Queue) lamp(floor driver.Floor, dir driver.Direction, on bool) {
+	if q.cfg.Lamp != nil {
+		q.cfg.Lamp(floor, dir, on)
+	}
 }
 
-// SetTimeoutCh is a channel for the queue to notify when a timer runs out, in order to wake the elvator.
-func SetTimeoutCh(ch chan<- bool) {
-	timeoutCh = ch
+// logOrder gives a logger with the fields of an order
+func (q *Queue) logOrder(o *order) *log.Logger {
+	kv := []interface{}{"floor", o.floor, "dir", o.dir}
+	if o.call != nil {
+		kv = append(kv, "caller", o.call.Caller, "call", o.call.Seq, "dest", o.dest)
+	}
+	if o.accepted {
+		kv = append(kv, "owner", o.owner)
+	}
+	return q.log.With(kv...)
 }
 
-//ImportInternalLog imports any locally saved internal orders to the active queue. Called at init.
-func ImportInternalLog() {
-	intSlice := ReadLog()
+// send a message once we let go of the mutex. Must hold mutex.
+func (q *Queue) send(msg net.OrderMessage) {
+	q.outbox = append(q.outbox, msg)
+}
 
-	for i := 0; i < len(intSlice); i++ {
-		shouldStop[driver.DirectionNone][intSlice[i]] = true
-		driver.ButtonLightOn(driver.Floor(intSlice[i]), driver.DirectionNone)
+// unlock the mutex, then send what was sent while holding it
+func (q *Queue) unlock() {
+	outbox := q.outbox
+	q.outbox = nil
+	q.sendMutex.Lock()
+	defer q.sendMutex.Unlock()
+	q.mutex.Unlock()
+
+	if q.cfg.Send != nil {
+		for _, msg := range outbox {
+			q.cfg.Send(msg)
+		}
 	}
 }
 
-func isAhead(floor driver.Floor) bool {
-	if currentDir == driver.DirectionUp {
-		return floor > currentFloor
-	} else if currentDir == driver.DirectionDown {
-		return floor < currentFloor
+// ping the elevator to wake it. One ping is as good as many, so don't wait if there are some already.
+func (q *Queue) ping() {
+	select {
+	case q.cfg.Timeout <- true:
+	default:
 	}
+}
 
-	return false
+// SetDoorOpen tells the queue whether the door is open, for the cost of taking an order
+func (q *Queue) SetDoorOpen(open bool) {
+	q.mutex.Lock()
+	defer q.unlock()
+	q.doorOpen = open
 }
 
-func abs(a, b int16) int16 {
-	if a-b < 0 {
-		return b - a
+// Recover takes back the orders we were responsible for when we last ran. Called at init, once Update has told
+// where we are. Hall orders and destination calls are resumed at once, and the others told we still have them.
+// If we can't serve them, they're handed back instead, so nobody waits for our timers to run out.
+func (q *Queue) Recover(canServe bool) {
+	if q.cfg.OrderLog == nil {
+		return
+	}
+	q.mutex.Lock()
+	defer q.unlock()
+
+	for _, e := range q.cfg.OrderLog.Recover() {
+		if e.Floor < 0 || e.Floor >= q.cfg.NumFloors || (e.Call != nil && (e.Dest < 0 || e.Dest >= q.cfg.NumFloors)) {
+			q.log.With("floor", e.Floor, "dir", e.Dir).Warning("Logged order is outside the building, ignoring")
+			continue
+		}
+		if e.Dir == driver.DirectionNone {
+			if e.Floor == q.currentFloor {
+				// Already there
+				q.record(Entry{Done: true, Floor: e.Floor, Dir: driver.DirectionNone})
+				continue
+			}
+			q.shouldStop[driver.DirectionNone][e.Floor] = true
+			q.lamp(e.Floor, driver.DirectionNone, true)
+			continue
+		}
+
+		o := &order{floor: e.Floor, dir: q.hallDir(e.Floor, e.Dir), call: e.Call, dest: e.Dest}
+		if q.find(o.key()) != nil {
+			continue
+		}
+		o.timer = time.AfterFunc(timeoutDelay, func() { q.expire(o) })
+		q.pendingOrders.PushBack(o)
+		if o.call == nil {
+			q.lamp(o.floor, o.dir, true)
+		}
+
+		if canServe && q.inService {
+			// Ours until served, like any order we accept
+			q.logOrder(o).Info("Resuming order")
+			o.timer.Stop()
+			q.accept(o)
+		} else {
+			// Like going out of service with it
+			q.logOrder(o).Info("Handing back order")
+			reset(o, timeoutDelay)
+			q.record(entryOf(o, true))
+			q.tell(net.ReleasedOrder, o)
+		}
 	}
-	return a - b
 }
 
-func calculateTimeout(floor driver.Floor, dir driver.Direction) time.Duration {
-	var delay time.Duration
+// mine is whether we have accepted the order
+func (q *Queue) mine(o *order) bool {
+	return o.accepted && o.owner == q.cfg.ID
+}
+
+// record a change to our orders in the OrderLog
+func (q *Queue) record(e Entry) {
+	if q.cfg.OrderLog != nil {
+		q.cfg.OrderLog.Record(e)
+	}
+}
+
+func entryOf(o *order, done bool) Entry {
+	return Entry{Done: done, Floor: o.floor, Dir: o.dir, Call: o.call, Dest: o.dest}
+}
 
-	if !isAhead(floor) {
-		delay += 15 * delayUnit
+func keyOf(floor driver.Floor, dir driver.Direction, call *net.CallID) Key {
+	k := Key{Floor: floor, Dir: dir}
+	if call != nil {
+		k.IsCall, k.Call = true, *call
 	}
+	return k
+}
+
+// keyOf an order as we know it, with the direction normalized
+func (q *Queue) keyOf(floor driver.Floor, dir driver.Direction, call *net.CallID) Key {
+	return keyOf(floor, q.hallDir(floor, dir), call)
+}
 
-	if dir != currentDir {
-		delay += 10 * delayUnit
+// find the order with the key
+func (q *Queue) find(k Key) *list.Element {
+	for o := q.pendingOrders.Front(); o != nil; o = o.Next() {
+		if o.Value.(*order).key() == k {
+			return o
+		}
 	}
+	return nil
+}
 
-	delay += time.Duration(abs(int16(floor), int16(currentFloor))) * delayUnit
+// tell the others what happened to an order
+func (q *Queue) tell(t net.OrderType, o *order) {
+	q.send(net.OrderMessage{Type: t, Floor: o.floor, Direction: o.dir, Call: o.call})
+}
 
-	if currentDir == driver.DirectionNone {
-		delay = delayUnit * time.Duration(elevID)
+// hallDir maps the missing button at the end floors to the one that is there, so orders compare equal
+func (q *Queue) hallDir(floor driver.Floor, dir driver.Direction) driver.Direction {
+	if floor == 0 {
+		return driver.DirectionDown
+	} else if floor == q.cfg.NumFloors-1 {
+		return driver.DirectionUp
 	}
+	return dir
+}
 
-	return delay
+// SetDirection tells which way we were going, e.g. before a restart, so NextDirection carries on that way
+func (q *Queue) SetDirection(dir driver.Direction) {
+	q.mutex.Lock()
+	defer q.unlock()
+	q.currentDir = dir
 }
 
 // Update is called when the elevator passes a floor
-func Update(floor driver.Floor) {
-	currentFloor = floor
+func (q *Queue) Update(floor driver.Floor) {
+	q.mutex.Lock()
+	defer q.unlock()
+	q.currentFloor = floor
 }
 
-func gotoDir(floor driver.Floor) driver.Direction {
-	if floor > currentFloor {
+// gotoDir is the way from one floor to another
+func gotoDir(from, to driver.Floor) driver.Direction {
+	if to > from {
 		return driver.DirectionUp
-	} else if floor < currentFloor {
+	} else if to < from {
 		return driver.DirectionDown
 	}
 
@@ -102,142 +307,454 @@ func gotoDir(floor driver.Floor) driver.Direction {
 }
 
 // ShouldStop at the floor?
-func ShouldStop(floor driver.Floor) bool {
-	if floor == 0 || floor == driver.NumFloors-1 {
+func (q *Queue) ShouldStop(floor driver.Floor) bool {
+	q.mutex.Lock()
+	defer q.unlock()
+	return q.stopAt(floor, q.currentDir, &q.shouldStop)
+}
+
+// stopAt is whether a car going dir with the given stops should stop at the floor
+func (q *Queue) stopAt(floor driver.Floor, dir driver.Direction, stops *[3][]bool) bool {
+	if floor == 0 || floor == q.cfg.NumFloors-1 {
 		return true
 	}
-	return shouldStop[currentDir][floor] || shouldStop[driver.DirectionNone][floor]
+	return stops[dir][floor] || stops[driver.DirectionNone][floor]
 }
 
 // NextDirection gives and sets next direction
-func NextDirection() driver.Direction {
+func (q *Queue) NextDirection() driver.Direction {
+	q.mutex.Lock()
+	defer q.unlock()
+	q.currentDir = q.nextDirection(q.currentFloor, q.currentDir, &q.shouldStop)
+	return q.currentDir
+}
+
+// nextDirection is where a car at floor, last going dir, with the given stops goes next
+func (q *Queue) nextDirection(floor driver.Floor, dir driver.Direction, stops *[3][]bool) driver.Direction {
+	numFloors := q.cfg.NumFloors
 	// BOOOOOOILERPLATE
-	if currentDir == driver.DirectionUp {
-		for i := currentFloor + 1; i < driver.NumFloors; i++ {
-			if shouldStop[driver.DirectionUp][i] || shouldStop[driver.DirectionNone][i] {
-				currentDir = gotoDir(driver.Floor(i))
-				return currentDir
+	if dir == driver.DirectionUp {
+		for i := floor + 1; i < numFloors; i++ {
+			if stops[driver.DirectionUp][i] || stops[driver.DirectionNone][i] {
+				return gotoDir(floor, i)
 			}
 		}
 		// then the other way
-		for i := driver.NumFloors - 1; i >= 0; i-- {
-			if shouldStop[driver.DirectionDown][i] || shouldStop[driver.DirectionNone][i] {
-				currentDir = gotoDir(driver.Floor(i))
-				return currentDir
+		for i := numFloors - 1; i >= 0; i-- {
+			if stops[driver.DirectionDown][i] || stops[driver.DirectionNone][i] {
+				return gotoDir(floor, i)
 			}
 		}
-		for i := 0; i < int(currentFloor); i++ {
-			if shouldStop[driver.DirectionUp][i] || shouldStop[driver.DirectionNone][i] {
-				currentDir = gotoDir(driver.Floor(i))
-				return currentDir
+		for i := driver.Floor(0); i < floor; i++ {
+			if stops[driver.DirectionUp][i] || stops[driver.DirectionNone][i] {
+				return gotoDir(floor, i)
 			}
 		}
 	} else {
-		for i := currentFloor - 1; i >= 0; i-- {
-			if shouldStop[driver.DirectionDown][i] || shouldStop[driver.DirectionNone][i] {
-				currentDir = gotoDir(driver.Floor(i))
-				return currentDir
+		for i := floor - 1; i >= 0; i-- {
+			if stops[driver.DirectionDown][i] || stops[driver.DirectionNone][i] {
+				return gotoDir(floor, i)
 			}
 		}
 		// then the other way
-		for i := 0; i < driver.NumFloors; i++ {
-			if shouldStop[driver.DirectionUp][i] || shouldStop[driver.DirectionNone][i] {
-				currentDir = gotoDir(driver.Floor(i))
-				return currentDir
+		for i := driver.Floor(0); i < numFloors; i++ {
+			if stops[driver.DirectionUp][i] || stops[driver.DirectionNone][i] {
+				return gotoDir(floor, i)
 			}
 		}
-		for i := driver.NumFloors - 1; i > int(currentFloor); i-- {
-			if shouldStop[driver.DirectionDown][i] || shouldStop[driver.DirectionNone][i] {
-				currentDir = gotoDir(driver.Floor(i))
-				return currentDir
+		for i := numFloors - 1; i > floor; i-- {
+			if stops[driver.DirectionDown][i] || stops[driver.DirectionNone][i] {
+				return gotoDir(floor, i)
 			}
 		}
 	}
-	currentDir = driver.DirectionNone
-	return currentDir
+	return driver.DirectionNone
 }
 
 // NewOrder locally or remotely
-func NewOrder(floor driver.Floor, dir driver.Direction) {
+func (q *Queue) NewOrder(floor driver.Floor, dir driver.Direction) {
+	q.mutex.Lock()
+	defer q.unlock()
+	q.newOrder(floor, dir)
+}
+
+func (q *Queue) newOrder(floor driver.Floor, dir driver.Direction) {
 	if dir == driver.DirectionNone { // From inside the elevator
-		shouldStop[dir][floor] = true
-		driver.ButtonLightOn(floor, dir)
-		AddToLog(int(floor)) //Log internal order to file
+		if !q.shouldStop[dir][floor] {
+			q.log.With("floor", floor, "dir", dir).Info("Cab order")
+			q.record(Entry{Floor: floor, Dir: dir})
+		}
+		q.shouldStop[dir][floor] = true
 	} else { // From external panel on this or some other elevator
+		dir = q.hallDir(floor, dir)
+		// Pressed again, or heard of from someone else too, is the order we have
+		if q.find(keyOf(floor, dir, nil)) == nil {
+			q.add(&order{floor: floor, dir: dir})
+		}
+	}
+	q.lamp(floor, dir, true)
+}
+
+// NewCall is a destination call: a passenger at floor wants to go to dest. It is assigned like a hall order,
+// and whoever takes it goes on to dest once the passenger is picked up.
+func (q *Queue) NewCall(floor driver.Floor, id net.CallID, dest driver.Floor) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	o := &order{floor: floor, dir: q.hallDir(floor, gotoDir(floor, dest)), call: &id, dest: dest}
+	if q.find(o.key()) != nil {
+		return
+	}
+	q.add(o)
+}
+
+// add a hall order or destination call, and put it up for grabs
+func (q *Queue) add(o *order) {
+	if o.call != nil {
+		q.logOrder(o).Info("New destination call")
+	} else {
+		q.logOrder(o).Info("New order")
+	}
+	o.timer = time.AfterFunc(timeoutDelay, func() { q.expire(o) })
+	q.open(o)
+	q.pendingOrders.PushBack(o)
+}
+
+// open puts an order up for grabs
+func (q *Queue) open(o *order) {
+	o.accepted, o.open, o.bids = false, true, nil
+	var delay time.Duration
+	if !q.offline {
+		eta := time.Duration(-1)
+		if q.inService {
+			eta = q.timeToServe(o.floor, o.dir)
+		}
+		delay = q.cfg.Assigner.Open(o.key(), eta, q.send)
+	}
+	reset(o, delay)
+}
+
+// reset the timer of an order
+func reset(o *order, d time.Duration) {
+	o.deadline = time.Now().Add(d)
+	o.timer.Reset(d)
+}
+
+// expire is called when the timer of an order runs out
+func (q *Queue) expire(o *order) {
+	q.mutex.Lock()
+	defer q.unlock()
 
-		if floor == 0 {
-			dir = driver.DirectionDown
-		} else if floor == driver.NumFloors-1 {
-			dir = driver.DirectionUp
+	if time.Now().Before(o.deadline) {
+		// Reset while firing, it'll fire again
+		return
+	}
+	if q.find(o.key()) == nil {
+		// Completed while firing
+		return
+	}
+	switch {
+	case q.offline || o.claim:
+		o.claim, o.open = false, false
+		q.accept(o)
+	case o.open:
+		o.open = false
+		if q.inService && q.cfg.Assigner.Decide(o.key()) {
+			q.accept(o)
+		} else {
+			// Someone else should take it, or open it again
+			reset(o, timeoutDelay)
+		}
+	default:
+		// Whoever had it took too long, or nobody took it
+		if o.accepted {
+			q.logOrder(o).Warning("Elevator ", o.owner, " took too long, putting the order up again")
+		} else {
+			q.logOrder(o).Info("Nobody took the order, putting it up again")
+		}
+		q.open(o)
+	}
+}
+
+// accept takes an order
+func (q *Queue) accept(o *order) {
+	if !q.inService {
+		// Open it again later, someone else should have taken it by then
+		reset(o, timeoutDelay)
+		return
+	}
+	q.shouldStop[o.dir][o.floor] = true
+	o.accepted, o.owner = true, q.cfg.ID
+	q.record(entryOf(o, false))
+	if q.currentDir == driver.DirectionNone {
+		q.ping()
+	}
+	// Send network message that we have accepted
+	q.tell(net.AcceptedOrder, o)
+	if o.call != nil {
+		q.logOrder(o).Info("Accepted destination call")
+	} else {
+		q.logOrder(o).Info("Accepted order")
+	}
+}
+
+// SetInService decides whether we take hall orders. Going out of service hands back the ones we have accepted.
+func (q *Queue) SetInService(in bool) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	q.inService = in
+	if in {
+		return
+	}
+	for o := q.pendingOrders.Front(); o != nil; o = o.Next() {
+		v := o.Value.(*order)
+		if q.mine(v) {
+			q.shouldStop[v.dir][v.floor] = false
+			v.accepted = false
+			q.record(entryOf(v, true))
+			reset(v, timeoutDelay)
+			q.tell(net.ReleasedOrder, v)
+			q.logOrder(v).Info("Released order")
 		}
+	}
+}
 
-		o := order{
-			floor: floor,
-			dir:   dir,
-			timer: time.AfterFunc(calculateTimeout(floor, dir), func() {
-				shouldStop[dir][floor] = true
-				if currentDir == driver.DirectionNone {
-					// Ping
-					timeoutCh <- true
-				}
-				// Send network message that we have accepted
-				net.SendOrder(net.OrderMessage{Type: net.AcceptedOrder, Floor: floor, Direction: dir})
-				log.Info("Accepted order for floor ", floor)
-			}),
+// SetOffline is called when the network goes down or comes back. While offline we take every hall order ourselves.
+func (q *Queue) SetOffline(off bool) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	q.offline = off
+	if !off {
+		return
+	}
+	for o := q.pendingOrders.Front(); o != nil; o = o.Next() {
+		v := o.Value.(*order)
+		if !v.accepted || v.owner != q.cfg.ID {
+			reset(v, 0)
 		}
+	}
+}
+
+// OrderReleased puts an order another elevator gave up on up for grabs again
+func (q *Queue) OrderReleased(floor driver.Floor, dir driver.Direction, call *net.CallID) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	if o := q.find(q.keyOf(floor, dir, call)); o != nil {
+		q.open(o.Value.(*order))
+		return
+	}
 
-		pendingOrders.PushBack(&o)
+	if call != nil {
+		q.log.With("floor", floor, "caller", call.Caller, "call", call.Seq).Warning("Unknown destination call released, its passenger is stranded")
+		return
 	}
-	driver.ButtonLightOn(floor, dir)
+	// Never heard of it, so treat it as new
+	q.newOrder(floor, dir)
 }
 
 // OrderAcceptedRemotely yay!
-func OrderAcceptedRemotely(floor driver.Floor, dir driver.Direction) {
-	if floor == 0 {
-		dir = driver.DirectionUp
-	} else if floor == driver.NumFloors-1 {
-		dir = driver.DirectionUp
-	}
+func (q *Queue) OrderAcceptedRemotely(floor driver.Floor, dir driver.Direction, id uint, call *net.CallID) {
+	q.mutex.Lock()
+	defer q.unlock()
+	q.acceptedRemotely(floor, dir, id, call)
+}
+
+func (q *Queue) acceptedRemotely(floor driver.Floor, dir driver.Direction, id uint, call *net.CallID) {
 	// Algorithmically excellent searching
-	for o := pendingOrders.Front(); o != nil; o = o.Next() {
+	if o := q.find(q.keyOf(floor, dir, call)); o != nil {
 		v := o.Value.(*order)
-		if v.floor == floor && v.dir == dir {
-			v.timer.Reset(timeoutDelay + calculateTimeout(floor, dir))
-			return
+		if q.mine(v) && id != q.cfg.ID {
+			q.record(entryOf(v, true))
 		}
+		v.accepted, v.owner, v.open = true, id, false
+		reset(v, q.serveTimeout(v, id))
+		return
 	}
 
 	// Already completed? Maybe a late package or wtf
-	log.Warning("Non-existant job accepted remotely")
+	q.log.With("floor", floor, "dir", dir, "owner", id).Warning("Non-existant job accepted remotely")
+}
+
+// serveTimeout is how long elevator id gets to serve an order it accepted: what it bid, or if it didn't,
+// a trip to the far end and back stopping everywhere, and acceptMargin
+func (q *Queue) serveTimeout(o *order, id uint) time.Duration {
+	eta, ok := o.bids[id]
+	if !ok {
+		eta = time.Duration(2*(q.cfg.NumFloors-1)) * (q.cfg.FloorTime + q.cfg.DoorTime)
+	}
+	return eta + acceptMargin
+}
+
+// PeerLost puts the orders a lost elevator had accepted up for grabs again, instead of waiting for them to time out
+func (q *Queue) PeerLost(id uint) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	for o := q.pendingOrders.Front(); o != nil; o = o.Next() {
+		v := o.Value.(*order)
+		if v.accepted && v.owner == id {
+			q.logOrder(v).Warning("Elevator ", id, " is lost, taking back its order")
+			q.open(v)
+		}
+	}
+}
+
+// Snapshot of all hall orders we know of, for elevators that just joined. Destination calls are left out,
+// an elevator that missed one can't serve it anyway.
+func (q *Queue) Snapshot() []net.HallOrder {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	var orders []net.HallOrder
+	for o := q.pendingOrders.Front(); o != nil; o = o.Next() {
+		v := o.Value.(*order)
+		if v.call != nil {
+			continue
+		}
+		orders = append(orders, net.HallOrder{Floor: v.floor, Direction: v.dir, Accepted: v.accepted, Owner: v.owner})
+	}
+	return orders
+}
+
+// Merge hall orders another elevator knows of into ours. It's a union, so an order whose completion
+// we missed comes back and gets served twice. Better twice than never.
+func (q *Queue) Merge(orders []net.HallOrder) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	for _, h := range orders {
+		var found *order
+		if o := q.find(q.keyOf(h.Floor, h.Direction, nil)); o != nil {
+			found = o.Value.(*order)
+		}
+
+		if found == nil {
+			q.log.With("floor", h.Floor, "dir", h.Direction).Info("Learned of order")
+			if !h.Accepted {
+				q.newOrder(h.Floor, h.Direction)
+				continue
+			}
+			// Somebody has it, no auction. Taken below.
+			o := &order{floor: h.Floor, dir: q.hallDir(h.Floor, h.Direction)}
+			o.timer = time.AfterFunc(timeoutDelay, func() { q.expire(o) })
+			q.pendingOrders.PushBack(o)
+			q.lamp(o.floor, o.dir, true)
+			found = o
+		} else if found.accepted {
+			// We already know who has it
+			continue
+		}
+		if !h.Accepted {
+			continue
+		}
+
+		if h.Owner == q.cfg.ID {
+			// They think we have it. We forgot, so take it now.
+			found.claim = true
+			reset(found, 0)
+		} else {
+			q.acceptedRemotely(h.Floor, h.Direction, h.Owner, nil)
+		}
+	}
 }
 
 //ClearOrderLocal is called by the local elevator, and clears both internal and external orders. Calls ClearOrder.
-func ClearOrderLocal(floor driver.Floor, dir driver.Direction) {
+func (q *Queue) ClearOrderLocal(floor driver.Floor, dir driver.Direction) {
+	q.mutex.Lock()
+	defer q.unlock()
+	q.clearOrderLocal(floor)
+}
+
+func (q *Queue) clearOrderLocal(floor driver.Floor) {
 	// Turn off inside too
-	shouldStop[driver.DirectionNone][floor] = false
-	driver.ButtonLightOff(floor, driver.DirectionNone)
-	dir = currentDir
-	RemoveFromLog(int(floor))
-	ClearOrder(floor, dir)
+	q.clearCab(floor)
+	dir := q.currentDir
+	q.pickUp(floor, q.hallDir(floor, dir))
+	q.clearOrder(floor, dir, nil)
 }
 
-// ClearOrder means an order is completed (either remotely or locally). Does not clear internal orders, but is called by ClearOrderLocal.
-func ClearOrder(floor driver.Floor, dir driver.Direction) {
-	if floor == 0 {
-		dir = driver.DirectionDown
-	} else if floor == driver.NumFloors-1 {
-		dir = driver.DirectionUp
+// clearCab clears the cab order for a floor, if there is one
+func (q *Queue) clearCab(floor driver.Floor) {
+	if q.shouldStop[driver.DirectionNone][floor] {
+		q.log.With("floor", floor, "dir", driver.DirectionNone).Info("Completed cab order")
+		q.record(Entry{Done: true, Floor: floor, Dir: driver.DirectionNone})
 	}
-	shouldStop[dir][floor] = false
-	driver.ButtonLightOff(floor, dir)
+	q.shouldStop[driver.DirectionNone][floor] = false
+	q.lamp(floor, driver.DirectionNone, false)
+}
 
-	// Clear from pendingOrders
-	for o := pendingOrders.Front(); o != nil; o = o.Next() {
+// pickUp the passengers of our destination calls waiting at the floor, and take them where they're going
+func (q *Queue) pickUp(floor driver.Floor, dir driver.Direction) {
+	for o := q.pendingOrders.Front(); o != nil; {
+		next := o.Next()
 		v := o.Value.(*order)
-		if v.floor == floor && v.dir == dir {
+		if v.call != nil && v.floor == floor && v.dir == dir && q.mine(v) {
+			q.logOrder(v).Info("Picked up destination call")
 			v.timer.Stop()
-			pendingOrders.Remove(o)
-			break
+			q.pendingOrders.Remove(o)
+			q.record(entryOf(v, true))
+			q.tell(net.CompletedOrder, v)
+			q.newOrder(v.dest, driver.DirectionNone)
+		}
+		o = next
+	}
+}
+
+// ServeHere opens for whoever waits where an idle car stands, as NextDirection never goes anywhere for them.
+// If someone does, we're now going their way, and true is returned. The door should open.
+// DirectionNone with true is a cab order for this floor, e.g. pressed while the stop button was in.
+func (q *Queue) ServeHere() (driver.Direction, bool) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	for _, dir := range []driver.Direction{driver.DirectionUp, driver.DirectionDown} {
+		dir = q.hallDir(q.currentFloor, dir)
+		if q.shouldStop[dir][q.currentFloor] {
+			q.currentDir = dir
+			q.clearOrderLocal(q.currentFloor)
+			return dir, true
+		}
+	}
+	if q.shouldStop[driver.DirectionNone][q.currentFloor] {
+		q.clearCab(q.currentFloor)
+		return driver.DirectionNone, true
+	}
+	return driver.DirectionNone, false
+}
+
+// ClearOrder means an order is completed (either remotely or locally). Does not clear internal orders, but is called by ClearOrderLocal.
+func (q *Queue) ClearOrder(floor driver.Floor, dir driver.Direction, call *net.CallID) {
+	q.mutex.Lock()
+	defer q.unlock()
+	q.clearOrder(floor, dir, call)
+}
+
+func (q *Queue) clearOrder(floor driver.Floor, dir driver.Direction, call *net.CallID) {
+	k := q.keyOf(floor, dir, call)
+	if o := q.find(k); o != nil {
+		v := o.Value.(*order)
+		v.timer.Stop()
+		q.pendingOrders.Remove(o)
+		q.logOrder(v).Info("Completed order")
+		if q.mine(v) {
+			q.record(entryOf(v, true))
+		}
+	}
+	if call != nil {
+		// Someone else picked up their passenger
+		return
+	}
+
+	for o := q.pendingOrders.Front(); o != nil; o = o.Next() {
+		if v := o.Value.(*order); v.floor == k.Floor && v.dir == k.Dir && q.mine(v) {
+			// Still have a destination call to pick up here
+			q.lamp(k.Floor, k.Dir, false)
+			return
 		}
 	}
+	q.shouldStop[k.Dir][k.Floor] = false
+	q.lamp(k.Floor, k.Dir, false)
 }
@@ -0,0 +1,553 @@
+package queue
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knutaldrin/elevator/driver"
+	"github.com/knutaldrin/elevator/net"
+)
+
+// holdAssigner never takes anything by itself, so no timer fires during a test. It counts auctions.
+type holdAssigner struct {
+	mutex  sync.Mutex
+	opened int
+}
+
+func (a *holdAssigner) Open(k Key, eta time.Duration, send func(net.OrderMessage)) time.Duration {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.opened++
+	return time.Hour
+}
+
+func (a *holdAssigner) Bid(k Key, id uint, cost uint32) {}
+
+func (a *holdAssigner) Decide(k Key) bool { return false }
+
+// memLog is an OrderLog in memory
+type memLog struct {
+	mutex   sync.Mutex
+	entries []Entry
+	recover []Entry
+}
+
+func (l *memLog) Record(e Entry) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = append(l.entries, e)
+}
+
+func (l *memLog) Recover() []Entry {
+	return l.recover
+}
+
+func (l *memLog) recorded() []Entry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]Entry(nil), l.entries...)
+}
+
+// sent collects what a queue tells the others
+type sent struct {
+	mutex sync.Mutex
+	msgs  []net.OrderMessage
+}
+
+func (s *sent) send(msg net.OrderMessage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.msgs = append(s.msgs, msg)
+}
+
+func (s *sent) types() []net.OrderType {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	types := make([]net.OrderType, len(s.msgs))
+	for i, m := range s.msgs {
+		types[i] = m.Type
+	}
+	return types
+}
+
+type testQueue struct {
+	*Queue
+	assigner *holdAssigner
+	sent     *sent
+	log      *memLog
+}
+
+func newTestQueue(t *testing.T) testQueue {
+	tq := testQueue{assigner: &holdAssigner{}, sent: &sent{}, log: &memLog{}}
+	tq.Queue = New(Config{
+		ID:        1,
+		NumFloors: 4,
+		FloorTime: time.Second,
+		DoorTime:  3 * time.Second,
+		Assigner:  tq.assigner,
+		Send:      tq.sent.send,
+		Timeout:   make(chan bool, 8),
+		OrderLog:  tq.log,
+	})
+	t.Cleanup(tq.stopTimers)
+	return tq
+}
+
+func (q *Queue) stopTimers() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for o := q.pendingOrders.Front(); o != nil; o = o.Next() {
+		o.Value.(*order).timer.Stop()
+	}
+}
+
+// pending gives the order with the key, nil if there is none
+func (q *Queue) pending(floor driver.Floor, dir driver.Direction) *order {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if o := q.find(q.keyOf(floor, dir, nil)); o != nil {
+		return o.Value.(*order)
+	}
+	return nil
+}
+
+// isMine is whether we have accepted the order
+func (q *Queue) isMine(o *order) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.mine(o)
+}
+
+func equalTypes(a, b []net.OrderType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNextDirectionAndShouldStop(t *testing.T) {
+	q := newTestQueue(t)
+	q.Update(1)
+
+	if dir := q.NextDirection(); dir != driver.DirectionNone {
+		t.Fatalf("idle queue goes %v", dir)
+	}
+
+	q.NewOrder(3, driver.DirectionNone)
+	if dir := q.NextDirection(); dir != driver.DirectionUp {
+		t.Fatalf("cab order above goes %v, expected up", dir)
+	}
+	if q.ShouldStop(2) {
+		t.Error("stops at 2 without an order there")
+	}
+
+	// Carries on up before turning for the one below
+	q.NewOrder(0, driver.DirectionNone)
+	if dir := q.NextDirection(); dir != driver.DirectionUp {
+		t.Fatalf("goes %v with orders both ways while going up, expected up", dir)
+	}
+
+	q.Update(3)
+	q.ClearOrderLocal(3, driver.DirectionUp)
+	if dir := q.NextDirection(); dir != driver.DirectionDown {
+		t.Fatalf("goes %v with only an order below, expected down", dir)
+	}
+}
+
+func TestShouldStopHallOrdersOnlyTheirWay(t *testing.T) {
+	q := newTestQueue(t)
+	q.Update(0)
+	q.mutex.Lock()
+	q.shouldStop[driver.DirectionDown][2] = true
+	q.shouldStop[driver.DirectionUp][1] = true
+	q.mutex.Unlock()
+
+	if dir := q.NextDirection(); dir != driver.DirectionUp {
+		t.Fatalf("goes %v, expected up", dir)
+	}
+	if !q.ShouldStop(1) {
+		t.Error("going up passes an up order")
+	}
+	if q.ShouldStop(2) {
+		t.Error("going up stops for a down order")
+	}
+	if !q.ShouldStop(3) {
+		t.Error("doesn't stop at the top floor")
+	}
+}
+
+func TestAcceptAndRelease(t *testing.T) {
+	q := newTestQueue(t)
+	q.NewOrder(2, driver.DirectionUp)
+	o := q.pending(2, driver.DirectionUp)
+	if o == nil {
+		t.Fatal("hall order not pending")
+	}
+	if q.assigner.opened != 1 {
+		t.Fatalf("opened %d auctions, expected 1", q.assigner.opened)
+	}
+
+	q.mutex.Lock()
+	q.accept(o)
+	stop := q.shouldStop[driver.DirectionUp][2]
+	q.unlock()
+	if !stop || !q.isMine(o) {
+		t.Fatal("accepted order is not ours to stop for")
+	}
+	if !equalTypes(q.sent.types(), []net.OrderType{net.AcceptedOrder}) {
+		t.Fatalf("sent %v, expected AC", q.sent.types())
+	}
+	if entries := q.log.recorded(); len(entries) != 1 || entries[0].Done {
+		t.Fatalf("logged %v, expected the order added", entries)
+	}
+
+	q.SetInService(false)
+	q.mutex.Lock()
+	stop = q.shouldStop[driver.DirectionUp][2]
+	q.mutex.Unlock()
+	if stop || q.isMine(o) {
+		t.Fatal("order still ours out of service")
+	}
+	if !equalTypes(q.sent.types(), []net.OrderType{net.AcceptedOrder, net.ReleasedOrder}) {
+		t.Fatalf("sent %v, expected AC RL", q.sent.types())
+	}
+	if entries := q.log.recorded(); len(entries) != 2 || !entries[1].Done {
+		t.Fatalf("logged %v, expected the order done", entries)
+	}
+
+	// Out of service, we don't take it
+	q.mutex.Lock()
+	q.accept(o)
+	q.unlock()
+	if q.isMine(o) {
+		t.Fatal("accepted an order out of service")
+	}
+}
+
+func TestAcceptedRemotelyAndPeerLost(t *testing.T) {
+	q := newTestQueue(t)
+	q.NewOrder(1, driver.DirectionDown)
+	q.OrderAcceptedRemotely(1, driver.DirectionDown, 7, nil)
+
+	o := q.pending(1, driver.DirectionDown)
+	if !o.accepted || o.owner != 7 || o.open {
+		t.Fatalf("order accepted %v by %d, open %v, expected taken by 7", o.accepted, o.owner, o.open)
+	}
+
+	q.PeerLost(8)
+	if !o.accepted {
+		t.Fatal("losing someone else gave the order back")
+	}
+
+	q.PeerLost(7)
+	if o.accepted || !o.open {
+		t.Fatal("order of a lost elevator not up for grabs")
+	}
+	if q.assigner.opened != 2 {
+		t.Fatalf("opened %d auctions, expected 2", q.assigner.opened)
+	}
+}
+
+func TestAcceptedRemotelyTakesOurs(t *testing.T) {
+	q := newTestQueue(t)
+	q.NewOrder(2, driver.DirectionDown)
+	o := q.pending(2, driver.DirectionDown)
+	q.mutex.Lock()
+	q.accept(o)
+	q.unlock()
+
+	q.OrderAcceptedRemotely(2, driver.DirectionDown, 3, nil)
+	if q.isMine(o) {
+		t.Fatal("still ours after someone else took it")
+	}
+	if entries := q.log.recorded(); len(entries) != 2 || !entries[1].Done {
+		t.Fatalf("logged %v, expected the order done", entries)
+	}
+}
+
+func TestAcceptedRemotelyDeadline(t *testing.T) {
+	q := newTestQueue(t)
+	q.NewOrder(2, driver.DirectionUp)
+	q.NewOrder(1, driver.DirectionDown)
+	q.Bid(2, driver.DirectionUp, nil, 7, 4000)
+	q.Bid(2, driver.DirectionUp, nil, 8, 1000)
+
+	start := time.Now()
+	q.OrderAcceptedRemotely(2, driver.DirectionUp, 7, nil)
+	q.OrderAcceptedRemotely(1, driver.DirectionDown, 7, nil)
+
+	tests := []struct {
+		o    *order
+		want time.Duration
+	}{
+		{q.pending(2, driver.DirectionUp), 4*time.Second + acceptMargin},
+		// No bid: up and down, stopping at every floor
+		{q.pending(1, driver.DirectionDown), 6*4*time.Second + acceptMargin},
+	}
+	for _, tt := range tests {
+		q.mutex.Lock()
+		got := tt.o.deadline.Sub(start)
+		q.mutex.Unlock()
+		if got < tt.want || got > tt.want+time.Second {
+			t.Errorf("floor %d: deadline in %v, expected %v", tt.o.floor, got, tt.want)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	q := newTestQueue(t)
+	q.Merge([]net.HallOrder{
+		{Floor: 1, Direction: driver.DirectionUp},
+		{Floor: 2, Direction: driver.DirectionDown, Accepted: true, Owner: 5},
+	})
+
+	unaccepted := q.pending(1, driver.DirectionUp)
+	if unaccepted == nil || unaccepted.accepted || !unaccepted.open {
+		t.Fatal("unaccepted order not up for grabs")
+	}
+	taken := q.pending(2, driver.DirectionDown)
+	if taken == nil || !taken.accepted || taken.owner != 5 || taken.open {
+		t.Fatal("order accepted by 5 not known as taken")
+	}
+	if q.assigner.opened != 1 {
+		t.Fatalf("opened %d auctions, expected 1, for the unaccepted order only", q.assigner.opened)
+	}
+
+	// Again changes nothing
+	q.Merge([]net.HallOrder{{Floor: 2, Direction: driver.DirectionDown, Accepted: true, Owner: 6}})
+	if taken.owner != 5 {
+		t.Fatalf("owner changed to %d by a snapshot", taken.owner)
+	}
+	if len(q.sent.types()) != 0 {
+		t.Fatalf("sent %v merging", q.sent.types())
+	}
+}
+
+func TestMergeOursClaims(t *testing.T) {
+	q := newTestQueue(t)
+	q.Merge([]net.HallOrder{{Floor: 2, Direction: driver.DirectionUp, Accepted: true, Owner: 1}})
+	o := q.pending(2, driver.DirectionUp)
+	if o == nil {
+		t.Fatal("order not pending")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for !q.isMine(o) {
+		if time.Now().After(deadline) {
+			t.Fatal("order they think is ours not taken")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if q.assigner.opened != 0 {
+		t.Fatalf("opened %d auctions for an order that was ours", q.assigner.opened)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	call := &net.CallID{Caller: 60000, Seq: 9}
+	entries := []Entry{
+		{Floor: 0, Dir: driver.DirectionNone}, // Where we are
+		{Floor: 2, Dir: driver.DirectionNone},
+		{Floor: 1, Dir: driver.DirectionUp},
+		{Floor: 3, Dir: driver.DirectionDown, Call: call, Dest: 0},
+		{Floor: 9, Dir: driver.DirectionUp}, // Outside the building
+	}
+
+	t.Run("resume", func(t *testing.T) {
+		q := newTestQueue(t)
+		q.log.recover = entries
+		q.Update(0)
+		q.Recover(true)
+
+		q.mutex.Lock()
+		cab0, cab2 := q.shouldStop[driver.DirectionNone][0], q.shouldStop[driver.DirectionNone][2]
+		q.mutex.Unlock()
+		if cab0 || !cab2 {
+			t.Errorf("cab stops at 0: %v, at 2: %v, expected only 2", cab0, cab2)
+		}
+		if o := q.pending(1, driver.DirectionUp); o == nil || !q.isMine(o) {
+			t.Error("hall order not resumed")
+		}
+		if !equalTypes(q.sent.types(), []net.OrderType{net.AcceptedOrder, net.AcceptedOrder}) {
+			t.Errorf("sent %v, expected AC for the hall order and the call", q.sent.types())
+		}
+		if len(q.log.entries) == 0 || q.log.entries[0] != (Entry{Done: true, Floor: 0, Dir: driver.DirectionNone}) {
+			t.Errorf("logged %v, expected the cab order here done first", q.log.entries)
+		}
+	})
+
+	t.Run("hand back", func(t *testing.T) {
+		q := newTestQueue(t)
+		q.log.recover = entries
+		q.Update(0)
+		q.Recover(false)
+
+		if o := q.pending(1, driver.DirectionUp); o == nil || o.accepted {
+			t.Error("hall order not handed back")
+		}
+		if !equalTypes(q.sent.types(), []net.OrderType{net.ReleasedOrder, net.ReleasedOrder}) {
+			t.Errorf("sent %v, expected RL for the hall order and the call", q.sent.types())
+		}
+		for _, e := range q.log.entries {
+			if !e.Done {
+				t.Errorf("logged %v taken while handing back", e)
+			}
+		}
+	})
+}
+
+func TestServeHereCab(t *testing.T) {
+	q := newTestQueue(t)
+	q.Update(1)
+	q.NewOrder(1, driver.DirectionNone)
+
+	if dir := q.NextDirection(); dir != driver.DirectionNone {
+		t.Fatalf("goes %v for a cab order where it is", dir)
+	}
+	dir, ok := q.ServeHere()
+	if !ok || dir != driver.DirectionNone {
+		t.Fatalf("ServeHere gave %v, %v, expected none, true", dir, ok)
+	}
+	q.mutex.Lock()
+	stop := q.shouldStop[driver.DirectionNone][1]
+	q.mutex.Unlock()
+	if stop {
+		t.Fatal("cab order still there")
+	}
+	if _, ok := q.ServeHere(); ok {
+		t.Fatal("served twice")
+	}
+}
+
+func TestSendsAfterUnlocking(t *testing.T) {
+	var q *Queue
+	var locked []net.OrderType
+	q = New(Config{
+		ID:        1,
+		NumFloors: 4,
+		Assigner:  NewCostAssigner(1, time.Hour, func() []net.Peer { return nil }),
+		Send: func(msg net.OrderMessage) {
+			// A broadcast may block, and must not hold up the queue while it does
+			if !q.mutex.TryLock() {
+				locked = append(locked, msg.Type)
+				return
+			}
+			q.mutex.Unlock()
+		},
+	})
+	t.Cleanup(q.stopTimers)
+
+	q.NewOrder(2, driver.DirectionUp)
+	q.mutex.Lock()
+	q.accept(q.find(q.keyOf(2, driver.DirectionUp, nil)).Value.(*order))
+	q.unlock()
+	q.SetInService(false)
+	if len(locked) != 0 {
+		t.Fatalf("sent %v holding the lock", locked)
+	}
+}
+
+// quickAssigner opens for a moment and takes every other floor, so the order timers run while a test goes on
+type quickAssigner struct{}
+
+func (quickAssigner) Open(k Key, eta time.Duration, send func(net.OrderMessage)) time.Duration {
+	return time.Millisecond
+}
+
+func (quickAssigner) Bid(k Key, id uint, cost uint32) {}
+
+func (quickAssigner) Decide(k Key) bool { return k.Floor%2 == 0 }
+
+// TestConcurrentUse hammers a queue from the buttons, the network and its own timers at once. Run with -race.
+func TestConcurrentUse(t *testing.T) {
+	const numFloors = 4
+	var lampMutex sync.Mutex
+	var lamps [3][numFloors]bool
+
+	q := New(Config{
+		ID:        1,
+		NumFloors: numFloors,
+		FloorTime: time.Millisecond,
+		DoorTime:  time.Millisecond,
+		Assigner:  quickAssigner{},
+		Lamp: func(floor driver.Floor, dir driver.Direction, on bool) {
+			lampMutex.Lock()
+			defer lampMutex.Unlock()
+			lamps[dir][floor] = on
+		},
+		Send:    func(net.OrderMessage) {},
+		Timeout: make(chan bool, 1),
+	})
+	defer q.stopTimers()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < 300; i++ {
+				floor := driver.Floor(r.Intn(numFloors))
+				dir := driver.Direction(r.Intn(3))
+				hall := driver.Direction(r.Intn(2))
+				switch r.Intn(9) {
+				case 0, 1:
+					q.NewOrder(floor, dir)
+				case 2:
+					q.OrderAcceptedRemotely(floor, hall, uint(r.Intn(3)+1), nil)
+				case 3:
+					q.PeerLost(uint(r.Intn(2) + 2))
+				case 4:
+					q.Update(floor)
+					q.NextDirection()
+					q.ShouldStop(floor)
+					q.ServeHere()
+				case 5:
+					q.ClearOrderLocal(floor, dir)
+				case 6:
+					q.ClearOrder(floor, hall, nil)
+					q.OrderReleased(floor, hall, nil)
+				case 7:
+					q.Merge(q.Snapshot())
+				case 8:
+					q.SetInService(r.Intn(4) != 0)
+					q.SetDoorOpen(r.Intn(2) == 0)
+				}
+				if r.Intn(20) == 0 {
+					time.Sleep(time.Millisecond) // Let the timers in
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+
+	// Serve everything, and nothing should be left
+	q.SetInService(true)
+	for floor := driver.Floor(0); floor < numFloors; floor++ {
+		q.ClearOrder(floor, driver.DirectionUp, nil)
+		q.ClearOrder(floor, driver.DirectionDown, nil)
+		q.ClearOrderLocal(floor, driver.DirectionNone)
+	}
+	if orders := q.Snapshot(); len(orders) != 0 {
+		t.Errorf("orders left after serving everything: %+v", orders)
+	}
+	if dir := q.NextDirection(); dir != driver.DirectionNone {
+		t.Errorf("goes %v after serving everything", dir)
+	}
+	lampMutex.Lock()
+	defer lampMutex.Unlock()
+	for dir := range lamps {
+		for floor, on := range lamps[dir] {
+			if on {
+				t.Errorf("lamp of floor %d, dir %d still on", floor, dir)
+			}
+		}
+	}
+}
@@ -7,8 +7,11 @@ read IP
 echo "Set elevator ID:"
 read ID
 echo "Connecting to 129.241.187."$IP
+# The lab hardware is only in binaries built with -tags comedi
+(cd "$(dirname "$0")" && go build -tags comedi -o /home/student/go/bin/elevator .) || exit 1
 scp -rq /home/student/go/bin/elevator student@129.241.187.$IP:~/elevator
-ssh student@129.241.187.$IP "./elevator -id $ID"
+echo "Logging to ~/.elevator/elevator-$ID.log on the elevator"
+ssh student@129.241.187.$IP "./elevator -id $ID -logfile .elevator/elevator-$ID.log"
 
 echo Elevator script stopping...
 ssh student@129.241.187.$IP "killall elevator"
@@ -0,0 +1,168 @@
+// Package store keeps the state of elevators in files under a data directory, one set of files per
+// elevator ID, so several elevators on one machine keep out of each other's way. Files are replaced
+// atomically, and corrupt ones are moved aside for someone to look at instead of being trusted.
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/knutaldrin/elevator/log"
+)
+
+/** STATE FILE
+ * 4 bytes: magic, "ELVS"
+ * 2 bytes: schema version of the data
+ * 4 bytes: length of the data
+ * n bytes: data
+ * 4 bytes: CRC-32C of everything before
+ */
+
+var magic = []byte("ELVS")
+
+const headerLen = 4 + 2 + 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptError is a file we can't trust. It should be quarantined.
+type CorruptError struct {
+	Path   string
+	Reason string
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("%s is corrupt: %s", e.Path, e.Reason)
+}
+
+// Store is the state of one elevator
+type Store struct {
+	dir string
+	id  uint
+}
+
+// DefaultDir is where state is kept if nothing else is said: .elevator in the home directory
+func DefaultDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".elevator"
+	}
+	return filepath.Join(home, ".elevator")
+}
+
+// Open the store of an elevator, creating the directory if needed
+func Open(dir string, id uint) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Store{dir: dir, id: id}
+
+	// Left behind by crashing mid-write, the file they were for is still whole. Only what WriteFile names
+	// them, other files of ours may have .tmp in them too.
+	leftovers, _ := filepath.Glob(s.Path("*.tmp[0-9]*"))
+	for _, tmp := range leftovers {
+		os.Remove(tmp)
+	}
+	log.Info("Keeping state in ", dir)
+	return s, nil
+}
+
+// Path of a file of ours
+func (s *Store) Path(name string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("elevator-%d.%s", s.id, name))
+}
+
+// Write replaces a file of ours with data of the given schema version
+func (s *Store) Write(name string, schema uint16, data []byte) error {
+	buf := append([]byte(nil), magic...)
+	buf = binary.BigEndian.AppendUint16(buf, schema)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+	buf = append(buf, data...)
+	buf = binary.BigEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+	return WriteFile(s.Path(name), buf)
+}
+
+// Read a file of ours written with Write. Nil if there is none. A corrupt file, or one of another schema
+// version, is quarantined and a CorruptError given.
+func (s *Store) Read(name string, schema uint16) ([]byte, error) {
+	path := s.Path(name)
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	data, err := parse(path, buf, schema)
+	if err != nil {
+		Quarantine(path)
+		return nil, err
+	}
+	return data, nil
+}
+
+func parse(path string, buf []byte, schema uint16) ([]byte, error) {
+	if len(buf) < headerLen+4 || !bytes.Equal(buf[:len(magic)], magic) {
+		return nil, &CorruptError{path, "not a state file"}
+	}
+	n := int(binary.BigEndian.Uint32(buf[6:]))
+	if len(buf) != headerLen+n+4 {
+		return nil, &CorruptError{path, fmt.Sprintf("%d bytes, expected %d", len(buf), headerLen+n+4)}
+	}
+	if crc32.Checksum(buf[:headerLen+n], crcTable) != binary.BigEndian.Uint32(buf[headerLen+n:]) {
+		return nil, &CorruptError{path, "checksum mismatch"}
+	}
+	if v := binary.BigEndian.Uint16(buf[4:]); v != schema {
+		return nil, &CorruptError{path, fmt.Sprintf("schema version %d, expected %d", v, schema)}
+	}
+	return buf[headerLen : headerLen+n], nil
+}
+
+// WriteFile replaces the file at path with data, so that a crash leaves either the old or the new one.
+// The data goes to a temporary file, which is synced and renamed over the old one.
+func WriteFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes a rename in the directory stick
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Quarantine moves a corrupt file aside, next to where it was, and gives where it went
+func Quarantine(path string) string {
+	to := path + ".corrupt-" + time.Now().Format("20060102T150405")
+	if err := os.Rename(path, to); err != nil {
+		log.Error("Could not quarantine ", path, ": ", err)
+		return path
+	}
+	log.Error("Moved corrupt ", path, " to ", to)
+	return to
+}
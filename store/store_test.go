@@ -0,0 +1,115 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openStore(t *testing.T) *Store {
+	s, err := Open(t.TempDir(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestWriteRead(t *testing.T) {
+	s := openStore(t)
+	if data, err := s.Read("state", 1); data != nil || err != nil {
+		t.Fatalf("missing file gave %q, %v", data, err)
+	}
+
+	for _, data := range [][]byte{[]byte("floor 3, going up"), {}, []byte("replaced")} {
+		if err := s.Write("state", 1, data); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.Read("state", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("read %q, expected %q", got, data)
+		}
+	}
+
+	if tmps, _ := filepath.Glob(s.Path("*.tmp*")); len(tmps) != 0 {
+		t.Fatalf("temporary files left behind: %v", tmps)
+	}
+}
+
+func TestCorruptIsQuarantined(t *testing.T) {
+	corruptions := map[string]func([]byte) []byte{
+		"not a state file": func(buf []byte) []byte { buf[0] = 'X'; return buf },
+		"truncated":        func(buf []byte) []byte { return buf[:len(buf)-1] },
+		"bad checksum":     func(buf []byte) []byte { buf[headerLen]++; return buf },
+		"too short":        func(buf []byte) []byte { return buf[:5] },
+	}
+	for name, corrupt := range corruptions {
+		t.Run(name, func(t *testing.T) {
+			s := openStore(t)
+			if err := s.Write("state", 1, []byte("floor 3, going up")); err != nil {
+				t.Fatal(err)
+			}
+			path := s.Path("state")
+			buf, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, corrupt(buf), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := s.Read("state", 1)
+			if _, ok := err.(*CorruptError); !ok {
+				t.Fatalf("gave %q, %v, expected a CorruptError", data, err)
+			}
+			if quarantined, _ := filepath.Glob(path + ".corrupt-*"); len(quarantined) != 1 {
+				t.Fatalf("quarantined %v, expected one file", quarantined)
+			}
+			if data, err := s.Read("state", 1); data != nil || err != nil {
+				t.Fatalf("read %q, %v after quarantine, expected nothing", data, err)
+			}
+		})
+	}
+}
+
+func TestOtherSchemaIsRefused(t *testing.T) {
+	s := openStore(t)
+	if err := s.Write("state", 1, []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := s.Read("state", 2); err == nil {
+		t.Fatalf("schema 1 read as 2: %q", data)
+	}
+}
+
+func TestOpenRemovesLeftovers(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := s.Path("state") + ".tmp123"
+	other := filepath.Join(dir, "elevator-3.state.tmp123") // Another elevator's, maybe writing right now
+	notTmp := s.Path("log.20261018T093114.123.gz.tmp")     // Not one of WriteFile's
+	for _, path := range []string{tmp, other, notTmp} {
+		if err := os.WriteFile(path, []byte("half"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := Open(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Error("our leftover is still there")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Error("removed another elevator's file")
+	}
+	if _, err := os.Stat(notTmp); err != nil {
+		t.Error("removed a file WriteFile didn't leave")
+	}
+}